@@ -0,0 +1,609 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/aurora-is-near/nats-prober/eventlog"
+	"github.com/aurora-is-near/nats-prober/logger"
+	"github.com/aurora-is-near/nats-prober/natsprober"
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	Nats    NatsConfig    `json:"nats" yaml:"nats" toml:"nats"`
+	Prober  ProberConfig  `json:"prober" yaml:"prober" toml:"prober"`
+	Logger  LoggerConfig  `json:"logger" yaml:"logger" toml:"logger"`
+	Metrics MetricsConfig `json:"metrics" yaml:"metrics" toml:"metrics"`
+}
+
+// Duration is decoded from strings like "1m30s" in any config format.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+type NatsConfig struct {
+	URL              string `json:"url" yaml:"url" toml:"url"`
+	Name             string `json:"name" yaml:"name" toml:"name"`
+	CredsFile        string `json:"creds_file" yaml:"creds_file" toml:"creds_file"`
+	User             string `json:"user" yaml:"user" toml:"user"`
+	Password         string `json:"password" yaml:"password" toml:"password"`
+	Token            string `json:"token" yaml:"token" toml:"token"`
+	ConnectTimeoutMs uint   `json:"connect_timeout_ms" yaml:"connect_timeout_ms" toml:"connect_timeout_ms"`
+}
+
+type ProberConfig struct {
+	RequestSubjects          []string `json:"request_subjects" yaml:"request_subjects" toml:"request_subjects"`
+	ResponseSubjects         []string `json:"response_subjects" yaml:"response_subjects" toml:"response_subjects"`
+	RequestTimeoutSeconds    uint     `json:"request_timeout_seconds" yaml:"request_timeout_seconds" toml:"request_timeout_seconds"`
+	WorkersCount             uint     `json:"workers_count" yaml:"workers_count" toml:"workers_count"`
+	WorkerMaxPendingRequests uint     `json:"worker_max_pending_requests" yaml:"worker_max_pending_requests" toml:"worker_max_pending_requests"`
+	// Overrides request_timeout_seconds if set
+	RequestTimeout Duration `json:"request_timeout" yaml:"request_timeout" toml:"request_timeout"`
+	DropPolicy     string   `json:"drop_policy" yaml:"drop_policy" toml:"drop_policy"`
+	DropSampleRate float64  `json:"drop_sample_rate" yaml:"drop_sample_rate" toml:"drop_sample_rate"`
+	// Bytes of pending requests, 0 is unlimited
+	WorkerMaxPendingBytes uint64         `json:"worker_max_pending_bytes" yaml:"worker_max_pending_bytes" toml:"worker_max_pending_bytes"`
+	MaxPendingBytes       uint64         `json:"max_pending_bytes" yaml:"max_pending_bytes" toml:"max_pending_bytes"`
+	Policies              []PolicyConfig `json:"policies" yaml:"policies" toml:"policies"`
+
+	SyntheticProbes []SyntheticProbeConfig `json:"synthetic_probes" yaml:"synthetic_probes" toml:"synthetic_probes"`
+	Validators      []ValidatorConfig      `json:"validators" yaml:"validators" toml:"validators"`
+	CapturePolicies []CapturePolicyConfig  `json:"capture_policies" yaml:"capture_policies" toml:"capture_policies"`
+	// Stages applied in order to outcomes before they are logged
+	Pipeline []StageConfig `json:"pipeline" yaml:"pipeline" toml:"pipeline"`
+
+	ControlSubject string `json:"control_subject" yaml:"control_subject" toml:"control_subject"`
+	// Replies with prober stats as JSON, e.g. "$PROBER.STATS"
+	StatsSubject string `json:"stats_subject" yaml:"stats_subject" toml:"stats_subject"`
+
+	AutoscaleMaxWorkers       uint     `json:"autoscale_max_workers" yaml:"autoscale_max_workers" toml:"autoscale_max_workers"`
+	AutoscaleBacklogThreshold uint     `json:"autoscale_backlog_threshold" yaml:"autoscale_backlog_threshold" toml:"autoscale_backlog_threshold"`
+	AutoscaleInterval         Duration `json:"autoscale_interval" yaml:"autoscale_interval" toml:"autoscale_interval"`
+	AutoscaleSustainedChecks  uint     `json:"autoscale_sustained_checks" yaml:"autoscale_sustained_checks" toml:"autoscale_sustained_checks"`
+
+	WorkerQueueSize    uint `json:"worker_queue_size" yaml:"worker_queue_size" toml:"worker_queue_size"`
+	NonBlockingEnqueue bool `json:"non_blocking_enqueue" yaml:"non_blocking_enqueue" toml:"non_blocking_enqueue"`
+
+	AutoResponseSubjects       bool     `json:"auto_response_subjects" yaml:"auto_response_subjects" toml:"auto_response_subjects"`
+	AutoResponseInboxPrefix    string   `json:"auto_response_inbox_prefix" yaml:"auto_response_inbox_prefix" toml:"auto_response_inbox_prefix"`
+	ResponseSubscriptionExpiry Duration `json:"response_subscription_expiry" yaml:"response_subscription_expiry" toml:"response_subscription_expiry"`
+
+	GatherResponses    bool     `json:"gather_responses" yaml:"gather_responses" toml:"gather_responses"`
+	GatherWindow       Duration `json:"gather_window" yaml:"gather_window" toml:"gather_window"`
+	GatherMaxResponses uint     `json:"gather_max_responses" yaml:"gather_max_responses" toml:"gather_max_responses"`
+
+	Correlation CorrelationConfig `json:"correlation" yaml:"correlation" toml:"correlation"`
+
+	// Requests reusing the reply subject of a pending one queued behind it, the earliest one
+	// is reported as superseded beyond that
+	MaxDuplicateRequests uint `json:"max_duplicate_requests" yaml:"max_duplicate_requests" toml:"max_duplicate_requests"`
+
+	// Run handlers (event logging) on handler_workers goroutines, so that slow logging doesn't
+	// delay matching; outcomes beyond handler_queue_size per goroutine are only counted
+	HandlerWorkers   uint `json:"handler_workers" yaml:"handler_workers" toml:"handler_workers"`
+	HandlerQueueSize uint `json:"handler_queue_size" yaml:"handler_queue_size" toml:"handler_queue_size"`
+
+	// Wait for pending requests to resolve on shutdown for up to drain_timeout
+	DrainOnStop  bool     `json:"drain_on_stop" yaml:"drain_on_stop" toml:"drain_on_stop"`
+	DrainTimeout Duration `json:"drain_timeout" yaml:"drain_timeout" toml:"drain_timeout"`
+
+	Cluster             ClusterConfig `json:"cluster" yaml:"cluster" toml:"cluster"`
+	OrphanResponseGrace Duration      `json:"orphan_response_grace" yaml:"orphan_response_grace" toml:"orphan_response_grace"`
+}
+
+type PolicyConfig struct {
+	Subject    string   `json:"subject" yaml:"subject" toml:"subject"`
+	Timeout    Duration `json:"timeout" yaml:"timeout" toml:"timeout"`
+	MaxPending uint     `json:"max_pending" yaml:"max_pending" toml:"max_pending"`
+	DropPolicy string   `json:"drop_policy" yaml:"drop_policy" toml:"drop_policy"`
+	SampleRate float64  `json:"sample_rate" yaml:"sample_rate" toml:"sample_rate"`
+}
+
+type SyntheticProbeConfig struct {
+	Subject string `json:"subject" yaml:"subject" toml:"subject"`
+	// Payload and header values are Go templates with .Subject, .Seq and .Time
+	Payload string            `json:"payload" yaml:"payload" toml:"payload"`
+	Headers map[string]string `json:"headers" yaml:"headers" toml:"headers"`
+	// Requests per second
+	Rate   float64  `json:"rate" yaml:"rate" toml:"rate"`
+	Jitter Duration `json:"jitter" yaml:"jitter" toml:"jitter"`
+}
+
+type ValidatorConfig struct {
+	Subject string `json:"subject" yaml:"subject" toml:"subject"`
+	// One of "status_header", "max_size", "regex" or "json_schema"
+	Type string `json:"type" yaml:"type" toml:"type"`
+	// status_header
+	Header  string   `json:"header" yaml:"header" toml:"header"`
+	Allowed []string `json:"allowed" yaml:"allowed" toml:"allowed"`
+	// max_size
+	MaxBytes int `json:"max_bytes" yaml:"max_bytes" toml:"max_bytes"`
+	// regex
+	Pattern      string `json:"pattern" yaml:"pattern" toml:"pattern"`
+	MustNotMatch bool   `json:"must_not_match" yaml:"must_not_match" toml:"must_not_match"`
+	// json_schema, inline or from file
+	Schema     string `json:"schema" yaml:"schema" toml:"schema"`
+	SchemaFile string `json:"schema_file" yaml:"schema_file" toml:"schema_file"`
+}
+
+type CapturePolicyConfig struct {
+	Subject string `json:"subject" yaml:"subject" toml:"subject"`
+	// One of "full" (default), "none", "truncate" or "hash"
+	Mode     string `json:"mode" yaml:"mode" toml:"mode"`
+	MaxBytes int    `json:"max_bytes" yaml:"max_bytes" toml:"max_bytes"`
+	// Removed headers, case-insensitive
+	DenyHeaders []string `json:"deny_headers" yaml:"deny_headers" toml:"deny_headers"`
+	// Dot-separated paths of JSON fields to mask
+	RedactJSONFields []string `json:"redact_json_fields" yaml:"redact_json_fields" toml:"redact_json_fields"`
+	// Regular expressions to mask in payload and header values
+	RedactPatterns []string `json:"redact_patterns" yaml:"redact_patterns" toml:"redact_patterns"`
+}
+
+type StageConfig struct {
+	// One of "subject_filter", "header_labels", "sample", "rate_limit" or "latency_threshold"
+	Type string `json:"type" yaml:"type" toml:"type"`
+	// Outcomes the stage is applied to, all if empty
+	Outcomes []string `json:"outcomes" yaml:"outcomes" toml:"outcomes"`
+	// subject_filter
+	Subjects []string `json:"subjects" yaml:"subjects" toml:"subjects"`
+	Exclude  bool     `json:"exclude" yaml:"exclude" toml:"exclude"`
+	// header_labels, label names to header names
+	Labels map[string]string `json:"labels" yaml:"labels" toml:"labels"`
+	// sample (fraction of outcomes passed) and rate_limit (outcomes per second)
+	Rate  float64 `json:"rate" yaml:"rate" toml:"rate"`
+	Burst uint    `json:"burst" yaml:"burst" toml:"burst"`
+	// latency_threshold
+	MinLatency Duration `json:"min_latency" yaml:"min_latency" toml:"min_latency"`
+}
+
+type CorrelationConfig struct {
+	// One of "reply_subject" (default), "header" or "json_field"
+	Type     string `json:"type" yaml:"type" toml:"type"`
+	Header   string `json:"header" yaml:"header" toml:"header"`
+	JSONPath string `json:"json_path" yaml:"json_path" toml:"json_path"`
+}
+
+type ClusterConfig struct {
+	// Enables clustered mode if set
+	Subject           string   `json:"subject" yaml:"subject" toml:"subject"`
+	QueueGroup        string   `json:"queue_group" yaml:"queue_group" toml:"queue_group"`
+	InstanceID        string   `json:"instance_id" yaml:"instance_id" toml:"instance_id"`
+	HeartbeatInterval Duration `json:"heartbeat_interval" yaml:"heartbeat_interval" toml:"heartbeat_interval"`
+	MemberTimeout     Duration `json:"member_timeout" yaml:"member_timeout" toml:"member_timeout"`
+}
+
+type LoggerConfig struct {
+	EventFormat string `json:"event_format" yaml:"event_format" toml:"event_format"`
+
+	RealtimeSubject    string `json:"realtime_subject" yaml:"realtime_subject" toml:"realtime_subject"`
+	DelayedSubject     string `json:"delayed_subject" yaml:"delayed_subject" toml:"delayed_subject"`
+	DumpSubject        string `json:"dump_subject" yaml:"dump_subject" toml:"dump_subject"`
+	DumpTriggerSubject string `json:"dump_trigger_subject" yaml:"dump_trigger_subject" toml:"dump_trigger_subject"`
+
+	EnableDelayQueue bool   `json:"enable_delay_queue" yaml:"enable_delay_queue" toml:"enable_delay_queue"`
+	DelayMinutes     uint   `json:"delay_minutes" yaml:"delay_minutes" toml:"delay_minutes"`
+	DelayQueueSize   uint   `json:"delay_queue_size" yaml:"delay_queue_size" toml:"delay_queue_size"`
+	DelayQueueFile   string `json:"delay_queue_file" yaml:"delay_queue_file" toml:"delay_queue_file"`
+
+	EnableBatching    bool `json:"enable_batching" yaml:"enable_batching" toml:"enable_batching"`
+	MaxBatchSizeBytes uint `json:"max_batch_size_bytes" yaml:"max_batch_size_bytes" toml:"max_batch_size_bytes"`
+	MaxBatchAgeMs     uint `json:"max_batch_age_ms" yaml:"max_batch_age_ms" toml:"max_batch_age_ms"`
+}
+
+type MetricsConfig struct {
+	// Empty address disables metrics endpoint
+	ListenAddress string `json:"listen_address" yaml:"listen_address" toml:"listen_address"`
+	Path          string `json:"path" yaml:"path" toml:"path"`
+	// Further subjects are labeled as "_other"
+	MaxSubjects uint `json:"max_subjects" yaml:"max_subjects" toml:"max_subjects"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Nats: NatsConfig{
+			URL:              "nats://127.0.0.1:4222",
+			Name:             "nats-prober",
+			ConnectTimeoutMs: 5000,
+		},
+		Prober: ProberConfig{
+			RequestTimeoutSeconds:      10,
+			WorkersCount:               4,
+			WorkerMaxPendingRequests:   10000,
+			DropPolicy:                 "drop_oldest",
+			WorkerQueueSize:            100,
+			ResponseSubscriptionExpiry: Duration(time.Minute),
+			DrainTimeout:               Duration(time.Second * 10),
+		},
+		Logger: LoggerConfig{
+			EventFormat:       "json",
+			DelayMinutes:      60,
+			DelayQueueSize:    100000,
+			DelayQueueFile:    "delayqueue.db",
+			MaxBatchSizeBytes: 1024 * 1024,
+			MaxBatchAgeMs:     1000,
+		},
+		Metrics: MetricsConfig{
+			Path:        "/metrics",
+			MaxSubjects: 100,
+		},
+	}
+}
+
+// LoadConfig reads the config file, choosing the format by its extension
+// (.json, .yaml/.yml or .toml). Missing values keep their defaults.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := defaultConfig()
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		err = json.Unmarshal(data, config)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, config)
+	case ".toml":
+		err = toml.Unmarshal(data, config)
+	default:
+		return nil, fmt.Errorf("unsupported config format '%s'", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't parse config '%s': %w", path, err)
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (config *Config) validate() error {
+	if len(config.Nats.URL) == 0 {
+		return fmt.Errorf("nats.url is not set")
+	}
+	if len(config.Prober.RequestSubjects) == 0 && len(config.Prober.SyntheticProbes) == 0 {
+		return fmt.Errorf("prober.request_subjects and prober.synthetic_probes are empty")
+	}
+	if len(config.Prober.RequestSubjects) > 0 && len(config.Prober.ResponseSubjects) == 0 && !config.Prober.AutoResponseSubjects {
+		return fmt.Errorf("prober.response_subjects is empty and prober.auto_response_subjects is disabled")
+	}
+	if config.Prober.WorkersCount == 0 {
+		return fmt.Errorf("prober.workers_count must be positive")
+	}
+	if config.Prober.WorkerMaxPendingRequests == 0 {
+		return fmt.Errorf("prober.worker_max_pending_requests must be positive")
+	}
+	if _, err := config.Prober.Correlation.newCorrelator(); err != nil {
+		return fmt.Errorf("prober.correlation: %w", err)
+	}
+	if _, err := natsprober.ParseDropPolicy(config.Prober.DropPolicy); err != nil {
+		return fmt.Errorf("prober.drop_policy: %w", err)
+	}
+	if _, err := config.Prober.newPolicies(); err != nil {
+		return fmt.Errorf("prober.policies: %w", err)
+	}
+	if _, err := config.Prober.newValidators(); err != nil {
+		return fmt.Errorf("prober.validators: %w", err)
+	}
+	if _, err := config.Prober.newCapturePolicies(); err != nil {
+		return fmt.Errorf("prober.capture_policies: %w", err)
+	}
+	if _, err := config.Prober.newPipeline(); err != nil {
+		return fmt.Errorf("prober.pipeline: %w", err)
+	}
+	if err := natsprober.ValidateClusterInstanceID(config.Prober.Cluster.InstanceID); err != nil {
+		return fmt.Errorf("prober.cluster.instance_id: %w", err)
+	}
+	for _, probe := range config.Prober.SyntheticProbes {
+		if len(probe.Subject) == 0 {
+			return fmt.Errorf("prober.synthetic_probes: subject is not set")
+		}
+		if probe.Rate <= 0 {
+			return fmt.Errorf("prober.synthetic_probes: %s: rate must be positive", probe.Subject)
+		}
+	}
+	if _, err := eventlog.NewEncoder(config.Logger.EventFormat); err != nil {
+		return fmt.Errorf("logger.event_format: %w", err)
+	}
+	if len(config.Logger.RealtimeSubject) == 0 {
+		return fmt.Errorf("logger.realtime_subject is not set")
+	}
+	if config.Logger.EnableDelayQueue {
+		if len(config.Logger.DelayedSubject) == 0 || len(config.Logger.DumpSubject) == 0 || len(config.Logger.DumpTriggerSubject) == 0 {
+			return fmt.Errorf("logger.delayed_subject, logger.dump_subject and logger.dump_trigger_subject are required with delay queue")
+		}
+	}
+	return nil
+}
+
+func (config *ProberConfig) newProber() (*natsprober.NatsProber, error) {
+	correlator, err := config.Correlation.newCorrelator()
+	if err != nil {
+		return nil, err
+	}
+	dropPolicy, err := natsprober.ParseDropPolicy(config.DropPolicy)
+	if err != nil {
+		return nil, err
+	}
+	policies, err := config.newPolicies()
+	if err != nil {
+		return nil, err
+	}
+	validators, err := config.newValidators()
+	if err != nil {
+		return nil, err
+	}
+	capturePolicies, err := config.newCapturePolicies()
+	if err != nil {
+		return nil, err
+	}
+	pipeline, err := config.newPipeline()
+	if err != nil {
+		return nil, err
+	}
+	return &natsprober.NatsProber{
+		RequestSubjects:            config.RequestSubjects,
+		ResponseSubjects:           config.ResponseSubjects,
+		RequestTimeoutSeconds:      config.RequestTimeoutSeconds,
+		WorkersCount:               config.WorkersCount,
+		WorkerMaxPendingRequests:   config.WorkerMaxPendingRequests,
+		RequestTimeout:             time.Duration(config.RequestTimeout),
+		DropPolicy:                 dropPolicy,
+		DropSampleRate:             config.DropSampleRate,
+		WorkerMaxPendingBytes:      config.WorkerMaxPendingBytes,
+		MaxPendingBytes:            config.MaxPendingBytes,
+		Policies:                   policies,
+		SyntheticProbes:            config.newSyntheticProbes(),
+		Validators:                 validators,
+		CapturePolicies:            capturePolicies,
+		Pipeline:                   pipeline,
+		WorkerQueueSize:            config.WorkerQueueSize,
+		NonBlockingEnqueue:         config.NonBlockingEnqueue,
+		ControlSubject:             config.ControlSubject,
+		StatsSubject:               config.StatsSubject,
+		AutoscaleMaxWorkers:        config.AutoscaleMaxWorkers,
+		AutoscaleBacklogThreshold:  config.AutoscaleBacklogThreshold,
+		AutoscaleInterval:          time.Duration(config.AutoscaleInterval),
+		AutoscaleSustainedChecks:   config.AutoscaleSustainedChecks,
+		AutoResponseSubjects:       config.AutoResponseSubjects,
+		AutoResponseInboxPrefix:    config.AutoResponseInboxPrefix,
+		ResponseSubscriptionExpiry: time.Duration(config.ResponseSubscriptionExpiry),
+		GatherResponses:            config.GatherResponses,
+		GatherWindow:               time.Duration(config.GatherWindow),
+		GatherMaxResponses:         config.GatherMaxResponses,
+		Correlator:                 correlator,
+		ClusterSubject:             config.Cluster.Subject,
+		ClusterQueueGroup:          config.Cluster.QueueGroup,
+		ClusterInstanceID:          config.Cluster.InstanceID,
+		ClusterHeartbeatInterval:   time.Duration(config.Cluster.HeartbeatInterval),
+		ClusterMemberTimeout:       time.Duration(config.Cluster.MemberTimeout),
+		OrphanResponseGrace:        time.Duration(config.OrphanResponseGrace),
+		DrainOnStop:                config.DrainOnStop,
+		MaxDuplicateRequests:       config.MaxDuplicateRequests,
+		HandlerWorkers:             config.HandlerWorkers,
+		HandlerQueueSize:           config.HandlerQueueSize,
+	}, nil
+}
+
+func (config *ProberConfig) newValidators() ([]natsprober.SubjectValidator, error) {
+	var validators []natsprober.SubjectValidator
+	for _, validatorConfig := range config.Validators {
+		if len(validatorConfig.Subject) == 0 {
+			return nil, fmt.Errorf("subject is not set")
+		}
+		validator, err := validatorConfig.newValidator()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", validatorConfig.Subject, err)
+		}
+		validators = append(validators, natsprober.SubjectValidator{
+			Subject:   validatorConfig.Subject,
+			Validator: validator,
+		})
+	}
+	return validators, nil
+}
+
+func (config *ValidatorConfig) newValidator() (natsprober.Validator, error) {
+	switch config.Type {
+	case "status_header":
+		return natsprober.StatusHeaderValidator{Header: config.Header, Allowed: config.Allowed}, nil
+	case "max_size":
+		if config.MaxBytes <= 0 {
+			return nil, fmt.Errorf("max_bytes must be positive")
+		}
+		return natsprober.MaxSizeValidator{MaxBytes: config.MaxBytes}, nil
+	case "regex":
+		re, err := regexp.Compile(config.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		return natsprober.RegexValidator{Regexp: re, MustNotMatch: config.MustNotMatch}, nil
+	case "json_schema":
+		schema := []byte(config.Schema)
+		if len(config.SchemaFile) > 0 {
+			var err error
+			if schema, err = os.ReadFile(config.SchemaFile); err != nil {
+				return nil, err
+			}
+		}
+		return natsprober.NewJSONSchemaValidator(schema)
+	default:
+		return nil, fmt.Errorf("unknown validator type '%s'", config.Type)
+	}
+}
+
+func (config *ProberConfig) newCapturePolicies() ([]natsprober.CapturePolicy, error) {
+	var policies []natsprober.CapturePolicy
+	for _, policyConfig := range config.CapturePolicies {
+		if len(policyConfig.Subject) == 0 {
+			return nil, fmt.Errorf("subject is not set")
+		}
+		policy := natsprober.CapturePolicy{
+			Subject:          policyConfig.Subject,
+			MaxBytes:         policyConfig.MaxBytes,
+			DenyHeaders:      policyConfig.DenyHeaders,
+			RedactJSONFields: policyConfig.RedactJSONFields,
+		}
+		if len(policyConfig.Mode) > 0 {
+			var err error
+			if policy.Mode, err = natsprober.ParseCaptureMode(policyConfig.Mode); err != nil {
+				return nil, fmt.Errorf("%s: %w", policyConfig.Subject, err)
+			}
+		}
+		if policy.Mode == natsprober.CaptureTruncate && policy.MaxBytes <= 0 {
+			return nil, fmt.Errorf("%s: max_bytes must be positive", policyConfig.Subject)
+		}
+		for _, pattern := range policyConfig.RedactPatterns {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", policyConfig.Subject, err)
+			}
+			policy.RedactPatterns = append(policy.RedactPatterns, re)
+		}
+		policies = append(policies, policy)
+	}
+	return policies, nil
+}
+
+func (config *ProberConfig) newPipeline() ([]natsprober.Stage, error) {
+	var pipeline []natsprober.Stage
+	for _, stageConfig := range config.Pipeline {
+		stage, err := stageConfig.newStage()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", stageConfig.Type, err)
+		}
+		if len(stageConfig.Outcomes) > 0 {
+			outcomes := make([]natsprober.Outcome, len(stageConfig.Outcomes))
+			for i, outcome := range stageConfig.Outcomes {
+				if outcomes[i], err = natsprober.ParseOutcome(outcome); err != nil {
+					return nil, fmt.Errorf("%s: %w", stageConfig.Type, err)
+				}
+			}
+			stage = natsprober.ForOutcomes(stage, outcomes...)
+		}
+		pipeline = append(pipeline, stage)
+	}
+	return pipeline, nil
+}
+
+func (config *StageConfig) newStage() (natsprober.Stage, error) {
+	switch config.Type {
+	case "subject_filter":
+		if len(config.Subjects) == 0 {
+			return nil, fmt.Errorf("subjects are not set")
+		}
+		return natsprober.SubjectFilterStage{Subjects: config.Subjects, Exclude: config.Exclude}, nil
+	case "header_labels":
+		if len(config.Labels) == 0 {
+			return nil, fmt.Errorf("labels are not set")
+		}
+		return natsprober.HeaderLabelsStage{Labels: config.Labels}, nil
+	case "sample":
+		if config.Rate <= 0 || config.Rate > 1 {
+			return nil, fmt.Errorf("rate must be in (0, 1]")
+		}
+		return natsprober.SampleStage{Rate: config.Rate}, nil
+	case "rate_limit":
+		if config.Rate <= 0 {
+			return nil, fmt.Errorf("rate must be positive")
+		}
+		return &natsprober.RateLimitStage{Rate: config.Rate, Burst: config.Burst}, nil
+	case "latency_threshold":
+		return natsprober.LatencyThresholdStage{MinLatency: time.Duration(config.MinLatency)}, nil
+	default:
+		return nil, fmt.Errorf("unknown stage type")
+	}
+}
+
+func (config *ProberConfig) newSyntheticProbes() []natsprober.SyntheticProbe {
+	var probes []natsprober.SyntheticProbe
+	for _, probeConfig := range config.SyntheticProbes {
+		probes = append(probes, natsprober.SyntheticProbe{
+			Subject: probeConfig.Subject,
+			Payload: probeConfig.Payload,
+			Headers: probeConfig.Headers,
+			Rate:    probeConfig.Rate,
+			Jitter:  time.Duration(probeConfig.Jitter),
+		})
+	}
+	return probes
+}
+
+func (config *ProberConfig) newPolicies() ([]natsprober.SubjectPolicy, error) {
+	var policies []natsprober.SubjectPolicy
+	for _, policyConfig := range config.Policies {
+		if len(policyConfig.Subject) == 0 {
+			return nil, fmt.Errorf("subject is not set")
+		}
+		dropPolicy := config.DropPolicy
+		if len(policyConfig.DropPolicy) > 0 {
+			dropPolicy = policyConfig.DropPolicy
+		}
+		parsedDropPolicy, err := natsprober.ParseDropPolicy(dropPolicy)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", policyConfig.Subject, err)
+		}
+		policies = append(policies, natsprober.SubjectPolicy{
+			Subject:    policyConfig.Subject,
+			Timeout:    time.Duration(policyConfig.Timeout),
+			MaxPending: policyConfig.MaxPending,
+			DropPolicy: parsedDropPolicy,
+			SampleRate: policyConfig.SampleRate,
+		})
+	}
+	return policies, nil
+}
+
+func (config *CorrelationConfig) newCorrelator() (natsprober.Correlator, error) {
+	switch config.Type {
+	case "", "reply_subject":
+		return natsprober.ReplySubjectCorrelator{}, nil
+	case "header":
+		if len(config.Header) == 0 {
+			return nil, fmt.Errorf("header is not set")
+		}
+		return natsprober.HeaderCorrelator{Header: config.Header}, nil
+	case "json_field":
+		if len(config.JSONPath) == 0 {
+			return nil, fmt.Errorf("json_path is not set")
+		}
+		return natsprober.JSONFieldCorrelator{Path: config.JSONPath}, nil
+	default:
+		return nil, fmt.Errorf("unknown correlation type '%s'", config.Type)
+	}
+}
+
+func (config *LoggerConfig) newLogger() *logger.Logger {
+	return &logger.Logger{
+		RealtimeSubject:    config.RealtimeSubject,
+		DelayedSubject:     config.DelayedSubject,
+		DumpSubject:        config.DumpSubject,
+		DumpTriggerSubject: config.DumpTriggerSubject,
+		EnableDelayQueue:   config.EnableDelayQueue,
+		DelayMinutes:       config.DelayMinutes,
+		DelayQueueSize:     config.DelayQueueSize,
+		DelayQueueFile:     config.DelayQueueFile,
+		EnableBatching:     config.EnableBatching,
+		MaxBatchSizeBytes:  config.MaxBatchSizeBytes,
+		MaxBatchAgeMs:      config.MaxBatchAgeMs,
+	}
+}
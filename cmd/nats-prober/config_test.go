@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	return path
+}
+
+func TestLoadConfigFormats(t *testing.T) {
+	files := map[string]string{
+		"config.json": `{"prober": {"request_subjects": ["a.>"], "auto_response_subjects": true, "response_subscription_expiry": "30s", "workers_count": 2}, "logger": {"realtime_subject": "log"}}`,
+		"config.yaml": "prober:\n  request_subjects: [\"a.>\"]\n  auto_response_subjects: true\n  response_subscription_expiry: 30s\n  workers_count: 2\nlogger:\n  realtime_subject: log\n",
+		"config.toml": "[prober]\nrequest_subjects = [\"a.>\"]\nauto_response_subjects = true\nresponse_subscription_expiry = \"30s\"\nworkers_count = 2\n[logger]\nrealtime_subject = \"log\"\n",
+	}
+	for name, content := range files {
+		config, err := LoadConfig(writeConfig(t, name, content))
+		if err != nil {
+			t.Fatalf("%s: LoadConfig: %s", name, err)
+		}
+		if len(config.Prober.RequestSubjects) != 1 || config.Prober.RequestSubjects[0] != "a.>" {
+			t.Errorf("%s: wrong request subjects %v", name, config.Prober.RequestSubjects)
+		}
+		if time.Duration(config.Prober.ResponseSubscriptionExpiry) != time.Second*30 {
+			t.Errorf("%s: wrong response subscription expiry %v", name, config.Prober.ResponseSubscriptionExpiry)
+		}
+		if config.Prober.WorkersCount != 2 {
+			t.Errorf("%s: wrong workers count %d", name, config.Prober.WorkersCount)
+		}
+		if config.Prober.WorkerMaxPendingRequests != defaultConfig().Prober.WorkerMaxPendingRequests {
+			t.Errorf("%s: default not kept", name)
+		}
+		if config.Logger.RealtimeSubject != "log" {
+			t.Errorf("%s: wrong realtime subject %s", name, config.Logger.RealtimeSubject)
+		}
+	}
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	if _, err := LoadConfig(writeConfig(t, "config.yaml", "logger:\n  realtime_subject: log\n")); err == nil {
+		t.Error("Config without request subjects accepted")
+	}
+	synthetic := "prober:\n  synthetic_probes:\n    - subject: svc.health\n      rate: 2\n      jitter: 10ms\nlogger:\n  realtime_subject: log\n"
+	config, err := LoadConfig(writeConfig(t, "config.yaml", synthetic))
+	if err != nil {
+		t.Fatalf("Config with synthetic probes only rejected: %v", err)
+	}
+	if probes := config.Prober.newSyntheticProbes(); len(probes) != 1 || probes[0].Rate != 2 || probes[0].Jitter != time.Millisecond*10 {
+		t.Errorf("Wrong synthetic probes %+v", probes)
+	}
+	validators := "prober:\n  request_subjects: [svc]\n  auto_response_subjects: true\n  validators:\n    - subject: svc\n      type: json_schema\n      schema: '{\"type\": 1}'\nlogger:\n  realtime_subject: log\n"
+	if _, err := LoadConfig(writeConfig(t, "config.yaml", validators)); err == nil {
+		t.Error("Invalid JSON schema accepted")
+	}
+	capture := "prober:\n  request_subjects: [svc]\n  auto_response_subjects: true\n  capture_policies:\n    - subject: svc\n      mode: truncate\nlogger:\n  realtime_subject: log\n"
+	if _, err := LoadConfig(writeConfig(t, "config.yaml", capture)); err == nil {
+		t.Error("Truncate capture policy without max_bytes accepted")
+	}
+	pipeline := "prober:\n  request_subjects: [svc]\n  auto_response_subjects: true\n  pipeline:\n    - type: header_labels\n      labels: {tenant: X-Tenant}\n    - type: sample\n      rate: 0.1\n      outcomes: [successful]\n    - type: latency_threshold\n      min_latency: 100ms\nlogger:\n  realtime_subject: log\n"
+	config, err = LoadConfig(writeConfig(t, "config.yaml", pipeline))
+	if err != nil {
+		t.Fatalf("Config with pipeline rejected: %v", err)
+	}
+	if stages, err := config.Prober.newPipeline(); err != nil || len(stages) != 3 {
+		t.Errorf("Wrong pipeline %v: %v", stages, err)
+	}
+	badOutcome := "prober:\n  request_subjects: [svc]\n  auto_response_subjects: true\n  pipeline:\n    - type: sample\n      rate: 0.1\n      outcomes: [success]\nlogger:\n  realtime_subject: log\n"
+	if _, err := LoadConfig(writeConfig(t, "config.yaml", badOutcome)); err == nil {
+		t.Error("Pipeline stage with unknown outcome accepted")
+	}
+	instanceID := "prober:\n  request_subjects: [svc]\n  auto_response_subjects: true\n  cluster:\n    subject: prober.cluster\n    instance_id: host.1\nlogger:\n  realtime_subject: log\n"
+	if _, err := LoadConfig(writeConfig(t, "config.yaml", instanceID)); err == nil {
+		t.Error("Cluster instance id with '.' accepted")
+	}
+	if _, err := LoadConfig(writeConfig(t, "config.ini", "")); err == nil {
+		t.Error("Unknown format accepted")
+	}
+}
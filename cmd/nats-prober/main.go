@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/aurora-is-near/nats-prober/eventlog"
+	"github.com/aurora-is-near/nats-prober/metrics"
+	"github.com/nats-io/nats.go"
+)
+
+func main() {
+	configPath := flag.String("config", "config.yaml", "path to config file (.json, .yaml, .yml or .toml)")
+	flag.Parse()
+
+	config, err := LoadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("Can't load config: %v", err)
+	}
+
+	if err := run(config); err != nil {
+		log.Fatalf("%v", err)
+	}
+}
+
+func run(config *Config) error {
+	log.Printf("Connecting to NATS at %s...", config.Nats.URL)
+	nc, err := connect(&config.Nats)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	l := config.Logger.newLogger()
+	log.Printf("Starting logger...")
+	if err := l.Start(nc); err != nil {
+		return err
+	}
+	defer l.Stop()
+
+	encoder, err := eventlog.NewEncoder(config.Logger.EventFormat)
+	if err != nil {
+		return err
+	}
+
+	prober, err := config.Prober.newProber()
+	if err != nil {
+		return err
+	}
+	eventlog.Attach(prober, l, encoder)
+
+	if len(config.Metrics.ListenAddress) > 0 {
+		prober.Metrics = metrics.NewRegistry()
+		prober.MetricsMaxSubjects = config.Metrics.MaxSubjects
+		server := startMetricsServer(&config.Metrics, prober.Metrics)
+		defer stopMetricsServer(server)
+	}
+
+	log.Printf("Starting prober...")
+	if err := prober.Start(nc); err != nil {
+		return err
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-interrupt
+	log.Printf("Got signal %v, shutting down...", sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.Prober.DrainTimeout))
+	defer cancel()
+	if err := prober.Stop(ctx); err != nil {
+		log.Printf("Can't stop prober properly: %v", err)
+	}
+	return nil
+}
+
+func connect(config *NatsConfig) (*nats.Conn, error) {
+	options := []nats.Option{
+		nats.Name(config.Name),
+		nats.Timeout(time.Millisecond * time.Duration(config.ConnectTimeoutMs)),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			log.Printf("NATS: disconnected: %v", err)
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			log.Printf("NATS: reconnected to %s", nc.ConnectedUrl())
+		}),
+	}
+	if len(config.CredsFile) > 0 {
+		options = append(options, nats.UserCredentials(config.CredsFile))
+	}
+	if len(config.User) > 0 {
+		options = append(options, nats.UserInfo(config.User, config.Password))
+	}
+	if len(config.Token) > 0 {
+		options = append(options, nats.Token(config.Token))
+	}
+	return nats.Connect(config.URL, options...)
+}
+
+func startMetricsServer(config *MetricsConfig, registry *metrics.Registry) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle(config.Path, registry.Handler())
+	server := &http.Server{
+		Addr:    config.ListenAddress,
+		Handler: mux,
+	}
+
+	log.Printf("Serving metrics on %s%s...", config.ListenAddress, config.Path)
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Metrics server failed: %v", err)
+		}
+	}()
+	return server
+}
+
+func stopMetricsServer(server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Can't stop metrics server properly: %v", err)
+	}
+}
@@ -0,0 +1,131 @@
+package eventlog
+
+import (
+	"github.com/aurora-is-near/nats-prober/natsprober"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	cborUnsigned = 0 << 5
+	cborNegative = 1 << 5
+	cborText     = 3 << 5
+	cborArray    = 4 << 5
+	cborMap      = 5 << 5
+	cborTrue     = 7<<5 | 21
+)
+
+// CBOREncoder encodes events as CBOR maps (RFC 8949) keyed with the same
+// names as JSONEncoder, timestamps being unix nanoseconds.
+// Zero-valued fields are omitted.
+type CBOREncoder struct{}
+
+func (CBOREncoder) Encode(event *natsprober.ProbeEvent) ([]byte, error) {
+	type field struct {
+		key   string
+		value func(b []byte) []byte
+	}
+	var fields []field
+	addText := func(key string, value string) {
+		if len(value) > 0 {
+			fields = append(fields, field{key, func(b []byte) []byte { return appendCborText(b, value) }})
+		}
+	}
+	addInt := func(key string, value int64) {
+		if value != 0 {
+			fields = append(fields, field{key, func(b []byte) []byte { return appendCborInt(b, value) }})
+		}
+	}
+	addTrue := func(key string, value bool) {
+		if value {
+			fields = append(fields, field{key, func(b []byte) []byte { return append(b, cborTrue) }})
+		}
+	}
+	addHeader := func(key string, value nats.Header) {
+		if len(value) > 0 {
+			fields = append(fields, field{key, func(b []byte) []byte { return appendCborHeader(b, value) }})
+		}
+	}
+	addLabels := func(key string, value map[string]string) {
+		if len(value) > 0 {
+			fields = append(fields, field{key, func(b []byte) []byte { return appendCborLabels(b, value) }})
+		}
+	}
+
+	addText("outcome", string(event.Outcome))
+	addText("request_subject", event.RequestSubject)
+	addText("reply_subject", event.ReplySubject)
+	addInt("request_size", int64(event.RequestSize))
+	addInt("response_size", int64(event.ResponseSize))
+	addHeader("request_headers", event.RequestHeaders)
+	addHeader("response_headers", event.ResponseHeaders)
+	addInt("request_received_at", unixNano(event.RequestReceivedAt))
+	addInt("response_received_at", unixNano(event.ResponseReceivedAt))
+	addInt("latency_ns", int64(event.Latency))
+	addInt("ordinal", int64(event.Ordinal))
+	addInt("responses", int64(event.Responses))
+	addInt("last_latency_ns", int64(event.LastLatency))
+	addText("drop_reason", string(event.DropReason))
+	addTrue("synthetic", event.Synthetic)
+	addText("invalid_reason", event.InvalidReason)
+	addInt("status", int64(event.Status))
+	addText("request_hash", event.RequestPayloadHash)
+	addText("response_hash", event.ResponsePayloadHash)
+	addLabels("labels", event.Labels)
+
+	b := appendCborHead(nil, cborMap, uint64(len(fields)))
+	for _, f := range fields {
+		b = appendCborText(b, f.key)
+		b = f.value(b)
+	}
+	return b, nil
+}
+
+func appendCborHead(b []byte, major byte, value uint64) []byte {
+	switch {
+	case value < 24:
+		return append(b, major|byte(value))
+	case value <= 0xff:
+		return append(b, major|24, byte(value))
+	case value <= 0xffff:
+		return append(b, major|25, byte(value>>8), byte(value))
+	case value <= 0xffffffff:
+		return append(b, major|26, byte(value>>24), byte(value>>16), byte(value>>8), byte(value))
+	default:
+		return append(b, major|27,
+			byte(value>>56), byte(value>>48), byte(value>>40), byte(value>>32),
+			byte(value>>24), byte(value>>16), byte(value>>8), byte(value))
+	}
+}
+
+func appendCborInt(b []byte, value int64) []byte {
+	if value < 0 {
+		return appendCborHead(b, cborNegative, uint64(-1-value))
+	}
+	return appendCborHead(b, cborUnsigned, uint64(value))
+}
+
+func appendCborText(b []byte, value string) []byte {
+	b = appendCborHead(b, cborText, uint64(len(value)))
+	return append(b, value...)
+}
+
+func appendCborHeader(b []byte, header nats.Header) []byte {
+	b = appendCborHead(b, cborMap, uint64(len(header)))
+	for _, key := range sortedHeaderKeys(header) {
+		b = appendCborText(b, key)
+		b = appendCborHead(b, cborArray, uint64(len(header[key])))
+		for _, value := range header[key] {
+			b = appendCborText(b, value)
+		}
+	}
+	return b
+}
+
+func appendCborLabels(b []byte, labels map[string]string) []byte {
+	b = appendCborHead(b, cborMap, uint64(len(labels)))
+	for _, key := range sortedLabelKeys(labels) {
+		b = appendCborText(b, key)
+		b = appendCborText(b, labels[key])
+	}
+	return b
+}
@@ -0,0 +1,114 @@
+// Package eventlog encodes prober events and feeds them into the logger.
+package eventlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aurora-is-near/nats-prober/natsprober"
+	"github.com/nats-io/nats.go"
+)
+
+// Encoder serializes a single event into a log line.
+type Encoder interface {
+	Encode(event *natsprober.ProbeEvent) ([]byte, error)
+}
+
+// NewEncoder returns encoder by its format name: "json", "protobuf" or "cbor".
+func NewEncoder(format string) (Encoder, error) {
+	switch format {
+	case "", "json":
+		return JSONEncoder{}, nil
+	case "protobuf", "proto":
+		return ProtobufEncoder{}, nil
+	case "cbor":
+		return CBOREncoder{}, nil
+	default:
+		return nil, fmt.Errorf("unknown event format '%s'", format)
+	}
+}
+
+// JSONEncoder encodes events as single-line JSON objects.
+type JSONEncoder struct{}
+
+type jsonEvent struct {
+	Outcome            natsprober.Outcome    `json:"outcome"`
+	RequestSubject     string                `json:"request_subject,omitempty"`
+	ReplySubject       string                `json:"reply_subject,omitempty"`
+	RequestSize        int                   `json:"request_size,omitempty"`
+	ResponseSize       int                   `json:"response_size,omitempty"`
+	RequestHeaders     map[string][]string   `json:"request_headers,omitempty"`
+	ResponseHeaders    map[string][]string   `json:"response_headers,omitempty"`
+	RequestReceivedAt  *time.Time            `json:"request_received_at,omitempty"`
+	ResponseReceivedAt *time.Time            `json:"response_received_at,omitempty"`
+	LatencyNs          int64                 `json:"latency_ns,omitempty"`
+	Ordinal            uint                  `json:"ordinal,omitempty"`
+	Responses          uint                  `json:"responses,omitempty"`
+	LastLatencyNs      int64                 `json:"last_latency_ns,omitempty"`
+	DropReason         natsprober.DropReason `json:"drop_reason,omitempty"`
+	InvalidReason      string                `json:"invalid_reason,omitempty"`
+	Status             int                   `json:"status,omitempty"`
+	Synthetic          bool                  `json:"synthetic,omitempty"`
+	RequestHash        string                `json:"request_hash,omitempty"`
+	ResponseHash       string                `json:"response_hash,omitempty"`
+	Labels             map[string]string     `json:"labels,omitempty"`
+}
+
+func (JSONEncoder) Encode(event *natsprober.ProbeEvent) ([]byte, error) {
+	return json.Marshal(&jsonEvent{
+		Outcome:            event.Outcome,
+		RequestSubject:     event.RequestSubject,
+		ReplySubject:       event.ReplySubject,
+		RequestSize:        event.RequestSize,
+		ResponseSize:       event.ResponseSize,
+		RequestHeaders:     event.RequestHeaders,
+		ResponseHeaders:    event.ResponseHeaders,
+		RequestReceivedAt:  timeOrNil(event.RequestReceivedAt),
+		ResponseReceivedAt: timeOrNil(event.ResponseReceivedAt),
+		LatencyNs:          int64(event.Latency),
+		Ordinal:            event.Ordinal,
+		Responses:          event.Responses,
+		LastLatencyNs:      int64(event.LastLatency),
+		DropReason:         event.DropReason,
+		InvalidReason:      event.InvalidReason,
+		Status:             event.Status,
+		Synthetic:          event.Synthetic,
+		RequestHash:        event.RequestPayloadHash,
+		ResponseHash:       event.ResponsePayloadHash,
+		Labels:             event.Labels,
+	})
+}
+
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func sortedLabelKeys(labels map[string]string) []string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedHeaderKeys(header nats.Header) []string {
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
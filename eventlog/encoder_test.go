@@ -0,0 +1,146 @@
+package eventlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aurora-is-near/nats-prober/natsprober"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func testEvent() *natsprober.ProbeEvent {
+	requestTime := time.Unix(1000, 0)
+	return natsprober.NewProbeEvent(
+		natsprober.OutcomeSuccessful,
+		&natsprober.NatsMessage{
+			Msg: &nats.Msg{
+				Subject: "service.get",
+				Reply:   "_INBOX.abc.1",
+				Data:    []byte("request"),
+				Header:  nats.Header{"Trace": []string{"1", "2"}},
+			},
+			ReceivedAt: requestTime,
+		},
+		&natsprober.NatsMessage{
+			Msg:        &nats.Msg{Subject: "_INBOX.abc.1", Data: []byte("resp")},
+			ReceivedAt: requestTime.Add(time.Millisecond * 5),
+		},
+	)
+}
+
+func TestJSONEncoder(t *testing.T) {
+	event := testEvent()
+	event.Labels = map[string]string{"tenant": "a"}
+	data, err := JSONEncoder{}.Encode(event)
+	if err != nil {
+		t.Fatalf("Encode: %s", err)
+	}
+	if bytes.Contains(data, []byte("\n")) {
+		t.Error("Multiline JSON")
+	}
+	var decoded jsonEvent
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unmarshal: %s", err)
+	}
+	if decoded.Outcome != natsprober.OutcomeSuccessful || decoded.RequestSubject != "service.get" || decoded.ReplySubject != "_INBOX.abc.1" {
+		t.Errorf("Wrong subjects: %s", data)
+	}
+	if decoded.RequestSize != 7 || decoded.ResponseSize != 4 {
+		t.Errorf("Wrong sizes: %s", data)
+	}
+	if decoded.LatencyNs != int64(time.Millisecond*5) {
+		t.Errorf("Wrong latency: %s", data)
+	}
+	if len(decoded.RequestHeaders["Trace"]) != 2 || decoded.ResponseHeaders != nil {
+		t.Errorf("Wrong headers: %s", data)
+	}
+	if len(decoded.Labels) != 1 || decoded.Labels["tenant"] != "a" {
+		t.Errorf("Wrong labels: %s", data)
+	}
+}
+
+func TestProtobufEncoder(t *testing.T) {
+	event := testEvent()
+	event.Labels = map[string]string{"tenant": "a", "region": "b"}
+	data, err := ProtobufEncoder{}.Encode(event)
+	if err != nil {
+		t.Fatalf("Encode: %s", err)
+	}
+	strings := map[protowire.Number]string{}
+	varints := map[protowire.Number]uint64{}
+	headers := 0
+	labels := 0
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			t.Fatalf("ConsumeTag: %s", protowire.ParseError(n))
+		}
+		data = data[n:]
+		switch typ {
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(data)
+			varints[num] = v
+			data = data[n:]
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(data)
+			if num == pbRequestHeaders {
+				headers++
+			} else if num == pbLabels {
+				labels++
+			} else {
+				strings[num] = string(v)
+			}
+			data = data[n:]
+		default:
+			t.Fatalf("Unexpected wire type %d", typ)
+		}
+	}
+	if strings[pbOutcome] != "successful" || strings[pbRequestSubject] != "service.get" {
+		t.Errorf("Wrong strings: %v", strings)
+	}
+	if varints[pbLatencyNs] != uint64(time.Millisecond*5) || varints[pbRequestSize] != 7 {
+		t.Errorf("Wrong varints: %v", varints)
+	}
+	if varints[pbRequestReceivedAtUnixNano] != uint64(time.Unix(1000, 0).UnixNano()) {
+		t.Errorf("Wrong request time: %v", varints)
+	}
+	if headers != 1 {
+		t.Errorf("Wrong headers count: %d", headers)
+	}
+	if labels != 2 {
+		t.Errorf("Wrong labels count: %d", labels)
+	}
+}
+
+func TestCBOREncoder(t *testing.T) {
+	data, err := CBOREncoder{}.Encode(&natsprober.ProbeEvent{Outcome: natsprober.OutcomeUnknown})
+	if err != nil {
+		t.Fatalf("Encode: %s", err)
+	}
+	expected := append([]byte{0xa1, 0x67}, "outcome"...)
+	expected = append(append(expected, 0x67), "unknown"...)
+	if !bytes.Equal(data, expected) {
+		t.Errorf("Wrong encoding: %x", data)
+	}
+
+	data, err = CBOREncoder{}.Encode(&natsprober.ProbeEvent{Outcome: natsprober.OutcomeTimeouted, Synthetic: true})
+	if err != nil {
+		t.Fatalf("Encode: %s", err)
+	}
+	if !bytes.HasPrefix(data, []byte{0xa2}) || !bytes.HasSuffix(data, append([]byte("synthetic"), 0xf5)) {
+		t.Errorf("Wrong synthetic encoding: %x", data)
+	}
+
+	if b := appendCborInt(nil, -1); !bytes.Equal(b, []byte{0x20}) {
+		t.Errorf("Wrong -1: %x", b)
+	}
+	if b := appendCborInt(nil, 500); !bytes.Equal(b, []byte{0x19, 0x01, 0xf4}) {
+		t.Errorf("Wrong 500: %x", b)
+	}
+	if _, err := (CBOREncoder{}).Encode(testEvent()); err != nil {
+		t.Errorf("Encode: %s", err)
+	}
+}
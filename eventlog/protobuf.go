@@ -0,0 +1,108 @@
+package eventlog
+
+import (
+	"github.com/aurora-is-near/nats-prober/natsprober"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field numbers of ProbeEvent message, see probe_event.proto.
+const (
+	pbOutcome                    = 1
+	pbRequestSubject             = 2
+	pbReplySubject               = 3
+	pbRequestSize                = 4
+	pbResponseSize               = 5
+	pbRequestHeaders             = 6
+	pbResponseHeaders            = 7
+	pbRequestReceivedAtUnixNano  = 8
+	pbResponseReceivedAtUnixNano = 9
+	pbLatencyNs                  = 10
+	pbOrdinal                    = 11
+	pbResponses                  = 12
+	pbLastLatencyNs              = 13
+	pbDropReason                 = 14
+	pbSynthetic                  = 15
+	pbInvalidReason              = 16
+	pbStatus                     = 17
+	pbRequestHash                = 18
+	pbResponseHash               = 19
+	pbLabels                     = 20
+
+	pbHeaderKey    = 1
+	pbHeaderValues = 2
+
+	pbLabelKey   = 1
+	pbLabelValue = 2
+)
+
+// ProtobufEncoder encodes events as ProbeEvent protobuf messages (see probe_event.proto).
+// Zero-valued fields are omitted as in proto3.
+type ProtobufEncoder struct{}
+
+func (ProtobufEncoder) Encode(event *natsprober.ProbeEvent) ([]byte, error) {
+	var b []byte
+	b = appendPbString(b, pbOutcome, string(event.Outcome))
+	b = appendPbString(b, pbRequestSubject, event.RequestSubject)
+	b = appendPbString(b, pbReplySubject, event.ReplySubject)
+	b = appendPbVarint(b, pbRequestSize, uint64(event.RequestSize))
+	b = appendPbVarint(b, pbResponseSize, uint64(event.ResponseSize))
+	b = appendPbHeaders(b, pbRequestHeaders, event.RequestHeaders)
+	b = appendPbHeaders(b, pbResponseHeaders, event.ResponseHeaders)
+	b = appendPbVarint(b, pbRequestReceivedAtUnixNano, uint64(unixNano(event.RequestReceivedAt)))
+	b = appendPbVarint(b, pbResponseReceivedAtUnixNano, uint64(unixNano(event.ResponseReceivedAt)))
+	b = appendPbVarint(b, pbLatencyNs, uint64(event.Latency))
+	b = appendPbVarint(b, pbOrdinal, uint64(event.Ordinal))
+	b = appendPbVarint(b, pbResponses, uint64(event.Responses))
+	b = appendPbVarint(b, pbLastLatencyNs, uint64(event.LastLatency))
+	b = appendPbString(b, pbDropReason, string(event.DropReason))
+	b = appendPbVarint(b, pbSynthetic, protowire.EncodeBool(event.Synthetic))
+	b = appendPbString(b, pbInvalidReason, event.InvalidReason)
+	b = appendPbVarint(b, pbStatus, uint64(event.Status))
+	b = appendPbString(b, pbRequestHash, event.RequestPayloadHash)
+	b = appendPbString(b, pbResponseHash, event.ResponsePayloadHash)
+	b = appendPbLabels(b, pbLabels, event.Labels)
+	return b, nil
+}
+
+func appendPbString(b []byte, num protowire.Number, value string) []byte {
+	if len(value) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, value)
+}
+
+func appendPbVarint(b []byte, num protowire.Number, value uint64) []byte {
+	if value == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, value)
+}
+
+func appendPbHeaders(b []byte, num protowire.Number, header nats.Header) []byte {
+	for _, key := range sortedHeaderKeys(header) {
+		var entry []byte
+		entry = appendPbString(entry, pbHeaderKey, key)
+		for _, value := range header[key] {
+			entry = protowire.AppendTag(entry, pbHeaderValues, protowire.BytesType)
+			entry = protowire.AppendString(entry, value)
+		}
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	return b
+}
+
+// appendPbLabels encodes labels as map<string, string> entries.
+func appendPbLabels(b []byte, num protowire.Number, labels map[string]string) []byte {
+	for _, key := range sortedLabelKeys(labels) {
+		var entry []byte
+		entry = appendPbString(entry, pbLabelKey, key)
+		entry = appendPbString(entry, pbLabelValue, labels[key])
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	return b
+}
@@ -0,0 +1,42 @@
+package eventlog
+
+import (
+	"log"
+
+	"github.com/aurora-is-near/nats-prober/logger"
+	"github.com/aurora-is-near/nats-prober/natsprober"
+)
+
+// Writer encodes events and adds them to the logger under
+// "<SubjectPrefix><outcome>" subject suffix.
+type Writer struct {
+	Logger        *logger.Logger
+	Encoder       Encoder
+	SubjectPrefix string
+}
+
+// NewWriter creates writer with the default "." subject prefix.
+func NewWriter(l *logger.Logger, encoder Encoder) *Writer {
+	return &Writer{
+		Logger:        l,
+		Encoder:       encoder,
+		SubjectPrefix: ".",
+	}
+}
+
+// Write can be used as NatsProber event handler.
+func (writer *Writer) Write(event *natsprober.ProbeEvent) {
+	data, err := writer.Encoder.Encode(event)
+	if err != nil {
+		log.Printf("EventLog: can't encode event: %v", err)
+		return
+	}
+	writer.Logger.AddLogLine(data, writer.SubjectPrefix+string(event.Outcome))
+}
+
+// Attach makes prober emit all its events into the logger.
+func Attach(prober *natsprober.NatsProber, l *logger.Logger, encoder Encoder) *Writer {
+	writer := NewWriter(l, encoder)
+	prober.SetEventHandler(writer.Write)
+	return writer
+}
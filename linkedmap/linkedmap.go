@@ -115,3 +115,13 @@ func (m *LinkedMap[K, V]) PushLast(key K, value V) {
 
 	m.elements[key] = item
 }
+
+// ForEach calls f for each element from first to last, stopping if f returns false.
+// The map must not be modified during iteration.
+func (m *LinkedMap[K, V]) ForEach(f func(key K, value V) bool) {
+	for item := m.first; item != nil; item = item.next {
+		if !f(item.key, item.value) {
+			return
+		}
+	}
+}
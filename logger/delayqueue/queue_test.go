@@ -2,33 +2,82 @@ package delayqueue
 
 import (
 	"fmt"
-	"os"
+	"sync"
 	"testing"
 	"time"
 )
 
-func PrintFunc(d []byte) {
-	fmt.Printf("Send: %s\n", string(d))
+type collector struct {
+	mu       sync.Mutex
+	messages []string
+	times    []time.Time
 }
 
-func DumpFunc(d []byte) {
-	fmt.Printf("Dump: %s\n", string(d))
+func (c *collector) add(d []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.messages = append(c.messages, string(d))
+	c.times = append(c.times, time.Now())
+}
+
+func (c *collector) getTimes() []time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]time.Time(nil), c.times...)
+}
+
+func (c *collector) get() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.messages...)
 }
 
 func TestDelayQueue(t *testing.T) {
-	dir, _ := os.MkdirTemp("/tmp", "delayqueue.")
-	queue, err := Init(dir, 5, PrintFunc, DumpFunc)
+	var sent, dumped collector
+	queue, err := Init(t.TempDir(), 1, sent.add, dumped.add)
 	if err != nil {
 		t.Fatalf("Init: %s", err)
 	}
-	for i := 0; i < 100; i++ {
-		msg := []byte(fmt.Sprintf("Message: %d", i))
-		fmt.Printf("Queue: %s\n", string(msg))
-		queue.AddMsg(msg)
+	defer queue.Stop()
+
+	// Loop is kept well under the delay, so that sending early is noticed
+	added := make([]time.Time, 100)
+	for i := range added {
+		added[i] = time.Now()
+		queue.AddMsg([]byte(fmt.Sprintf("Message: %d", i)))
 		if i == 30 {
 			queue.Dump()
 		}
-		time.Sleep(time.Millisecond * 100)
+		time.Sleep(time.Millisecond)
+	}
+
+	deadline := time.Now().Add(time.Second * 5)
+	for len(sent.get()) < 100 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 50)
+	}
+
+	messages := sent.get()
+	if len(messages) != 100 {
+		t.Fatalf("Wrong number of sent messages %d", len(messages))
+	}
+	for i, msg := range messages {
+		if msg != fmt.Sprintf("Message: %d", i) {
+			t.Fatalf("Wrong sent message '%s' at %d", msg, i)
+		}
+	}
+	for i, sentAt := range sent.getTimes() {
+		if delay := sentAt.Sub(added[i]); delay < time.Second {
+			t.Fatalf("Message %d sent after %v, before delay", i, delay)
+		}
+	}
+
+	dumps := dumped.get()
+	if len(dumps) != 31 {
+		t.Fatalf("Wrong number of dumped messages %d", len(dumps))
+	}
+	for i, msg := range dumps {
+		if msg != fmt.Sprintf("Message: %d", i) {
+			t.Fatalf("Wrong dumped message '%s' at %d", msg, i)
+		}
 	}
-	time.Sleep(time.Second * 10)
 }
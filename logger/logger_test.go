@@ -0,0 +1,92 @@
+package logger
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aurora-is-near/nats-prober/testutil"
+)
+
+func TestLoggerRealtime(t *testing.T) {
+	server := testutil.RunServer(t)
+	nc := testutil.Connect(t, server)
+	realtime := testutil.Subscribe(t, testutil.Connect(t, server), "log.>")
+
+	logger := &Logger{RealtimeSubject: "log"}
+	if err := logger.Start(nc); err != nil {
+		t.Fatalf("Can't start logger: %v", err)
+	}
+	defer logger.Stop()
+
+	logger.AddLogLine([]byte("line"), ".successful")
+	msg := realtime.Next(t)
+	if msg.Subject != "log.successful" || string(msg.Data) != "line" {
+		t.Errorf("Wrong realtime message '%s' on '%s'", msg.Data, msg.Subject)
+	}
+}
+
+func TestLoggerBatching(t *testing.T) {
+	server := testutil.RunServer(t)
+	nc := testutil.Connect(t, server)
+	realtime := testutil.Subscribe(t, testutil.Connect(t, server), "log")
+
+	logger := &Logger{
+		RealtimeSubject:   "log",
+		EnableBatching:    true,
+		MaxBatchSizeBytes: 1000,
+		MaxBatchAgeMs:     50,
+	}
+	if err := logger.Start(nc); err != nil {
+		t.Fatalf("Can't start logger: %v", err)
+	}
+	defer logger.Stop()
+
+	logger.AddLogLine([]byte("first"), ".successful")
+	logger.AddLogLine([]byte("second"), ".successful")
+	realtime.Next(t)
+	realtime.AssertNoMore(t, time.Millisecond*100)
+}
+
+func TestLoggerDumpTrigger(t *testing.T) {
+	server := testutil.RunServer(t)
+	nc := testutil.Connect(t, server)
+	subscriber := testutil.Connect(t, server)
+	realtime := testutil.Subscribe(t, subscriber, "log")
+	dump := testutil.Subscribe(t, subscriber, "log.dump")
+
+	logger := &Logger{
+		RealtimeSubject:    "log",
+		DelayedSubject:     "log.delayed",
+		DumpSubject:        "log.dump",
+		DumpTriggerSubject: "log.dump.trigger",
+		EnableDelayQueue:   true,
+		DelayMinutes:       60,
+		DelayQueueSize:     10,
+		DelayQueueFile:     filepath.Join(t.TempDir(), "delayqueue.db"),
+	}
+	if err := logger.Start(nc); err != nil {
+		t.Fatalf("Can't start logger: %v", err)
+	}
+	defer logger.Stop()
+	testutil.Flush(t, nc)
+
+	lines := []string{"a", "b", "c"}
+	for _, line := range lines {
+		logger.AddLogLine([]byte(line), "")
+	}
+	for _, line := range lines {
+		if msg := realtime.Next(t); string(msg.Data) != line {
+			t.Errorf("Wrong realtime line '%s', expected '%s'", msg.Data, line)
+		}
+	}
+
+	if err := subscriber.Publish("log.dump.trigger", nil); err != nil {
+		t.Fatalf("Can't trigger dump: %v", err)
+	}
+	for _, line := range lines {
+		if msg := dump.Next(t); string(msg.Data) != line {
+			t.Errorf("Wrong dumped line '%s', expected '%s'", msg.Data, line)
+		}
+	}
+}
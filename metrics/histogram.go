@@ -0,0 +1,82 @@
+package metrics
+
+import (
+	"math"
+	"math/bits"
+	"sync/atomic"
+)
+
+const (
+	// Each power-of-two range is split into 2^precisionBits linear sub-buckets,
+	// which keeps relative bucket width under 1/2^precisionBits (~6%).
+	precisionBits = 4
+	subBuckets    = 1 << precisionBits
+	bucketsCount  = (64-precisionBits)<<precisionBits + subBuckets
+)
+
+// Histogram is a lock-free HDR-style histogram of non-negative integer values
+// with log-linear buckets covering the whole uint64 range.
+type Histogram struct {
+	counts [bucketsCount]uint64
+	count  uint64
+	sum    uint64
+}
+
+func bucketIndex(value uint64) int {
+	if value < subBuckets {
+		return int(value)
+	}
+	shift := bits.Len64(value) - 1 - precisionBits
+	return (shift+1)<<precisionBits + int(value>>shift) - subBuckets
+}
+
+// bucketUpperBound returns the largest value that falls into given bucket.
+func bucketUpperBound(index int) uint64 {
+	if index < subBuckets {
+		return uint64(index)
+	}
+	shift := index>>precisionBits - 1
+	mantissa := uint64(index - (shift+1)<<precisionBits + subBuckets)
+	// Wraps around to MaxUint64 for the very last bucket
+	return (mantissa+1)<<shift - 1
+}
+
+// Observe records value, negative values are counted as zero.
+func (h *Histogram) Observe(value int64) {
+	if value < 0 {
+		value = 0
+	}
+	atomic.AddUint64(&h.counts[bucketIndex(uint64(value))], 1)
+	atomic.AddUint64(&h.sum, uint64(value))
+	atomic.AddUint64(&h.count, 1)
+}
+
+// Count returns number of observed values.
+func (h *Histogram) Count() uint64 {
+	return atomic.LoadUint64(&h.count)
+}
+
+// Quantile returns upper bound of the bucket that contains q-th quantile (0 <= q <= 1).
+func (h *Histogram) Quantile(q float64) uint64 {
+	var snapshot [bucketsCount]uint64
+	var total uint64
+	for i := range h.counts {
+		snapshot[i] = atomic.LoadUint64(&h.counts[i])
+		total += snapshot[i]
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(total)))
+	if rank == 0 {
+		rank = 1
+	}
+	var seen uint64
+	for i, count := range snapshot {
+		seen += count
+		if seen >= rank {
+			return bucketUpperBound(i)
+		}
+	}
+	return bucketUpperBound(bucketsCount - 1)
+}
@@ -0,0 +1,122 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBucketBounds(t *testing.T) {
+	prevUpper := uint64(0)
+	for i := 0; i < bucketsCount; i++ {
+		upper := bucketUpperBound(i)
+		if i > 0 && upper <= prevUpper {
+			t.Fatalf("Bucket %d upper bound %d is not increasing", i, upper)
+		}
+		if bucketIndex(upper) != i {
+			t.Fatalf("Bucket %d upper bound %d maps to bucket %d", i, upper, bucketIndex(upper))
+		}
+		if bucketIndex(upper+1) != i+1 && i+1 < bucketsCount {
+			t.Fatalf("Value after bucket %d maps to bucket %d", i, bucketIndex(upper+1))
+		}
+		prevUpper = upper
+	}
+}
+
+func TestHistogramQuantile(t *testing.T) {
+	var h Histogram
+	for i := int64(1); i <= 1000; i++ {
+		h.Observe(i * 1000)
+	}
+	if h.Count() != 1000 {
+		t.Errorf("Wrong count %d", h.Count())
+	}
+	for _, q := range []float64{0.5, 0.9, 0.99} {
+		expected := q * 1000 * 1000
+		actual := float64(h.Quantile(q))
+		if actual < expected || actual > expected*(1+1.0/subBuckets) {
+			t.Errorf("Quantile %v: expected ~%v, got %v", q, expected, actual)
+		}
+	}
+}
+
+func TestRegistryHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterVec("test_total", "Test counter.", "kind").WithLabelValues("a").Add(3)
+	r.NewHistogramVec("test_seconds", "Test histogram.", 1e9, []float64{1e-6, 1e-5}, "subject").WithLabelValues("x").Observe(2000)
+	r.NewGaugeFunc("test_gauge", "Test gauge.", nil, func() []Sample {
+		return []Sample{{Value: 1.5}}
+	})
+
+	server := httptest.NewServer(r.Handler())
+	defer server.Close()
+
+	resp, err := server.Client().Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	for _, line := range []string{
+		"# TYPE test_total counter",
+		`test_total{kind="a"} 3`,
+		"# TYPE test_seconds histogram",
+		`test_seconds_bucket{subject="x",le="1e-06"} 0`,
+		`test_seconds_bucket{subject="x",le="1e-05"} 1`,
+		`test_seconds_bucket{subject="x",le="+Inf"} 1`,
+		`test_seconds_count{subject="x"} 1`,
+		`test_seconds_sum{subject="x"} 2e-06`,
+		"test_gauge 1.5",
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Errorf("Missing line %q in:\n%s", line, body)
+		}
+	}
+}
+
+func TestHistogramFixedBuckets(t *testing.T) {
+	r := NewRegistry()
+	v := r.NewHistogramVec("test_bytes", "Test histogram.", 1, ExponentialBuckets(10, 10, 3), "kind")
+	h := v.WithLabelValues("a")
+	for _, value := range []int64{1, 10, 50, 900, 1e6} {
+		h.Observe(value)
+	}
+
+	var buf strings.Builder
+	if _, err := r.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo: %s", err)
+	}
+	expected := `# HELP test_bytes Test histogram.
+# TYPE test_bytes histogram
+test_bytes_bucket{kind="a",le="10"} 2
+test_bytes_bucket{kind="a",le="100"} 3
+test_bytes_bucket{kind="a",le="1000"} 4
+test_bytes_bucket{kind="a",le="+Inf"} 5
+test_bytes_sum{kind="a"} 1.000961e+06
+test_bytes_count{kind="a"} 5
+`
+	if buf.String() != expected {
+		t.Errorf("Wrong output:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
+
+func TestLabelEscaping(t *testing.T) {
+	for _, c := range []struct {
+		value    string
+		expected string
+	}{
+		{"plain", `{v="plain"}`},
+		{`back\slash`, `{v="back\\slash"}`},
+		{`"quoted"`, `{v="\"quoted\""}`},
+		{"line\nfeed", `{v="line\nfeed"}`},
+		{"tab\tand\x01", "{v=\"tab\tand\x01\"}"},
+		{"unicode ✓", `{v="unicode ✓"}`},
+		{"bad\xffutf8", `{v="bad�utf8"}`},
+	} {
+		if actual := formatLabels([]string{"v"}, []string{c.value}); actual != c.expected {
+			t.Errorf("Wrong labels for %q: %s, expected %s", c.value, actual, c.expected)
+		}
+	}
+}
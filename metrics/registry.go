@@ -0,0 +1,350 @@
+// Package metrics implements a minimal metrics registry exposed in Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type collector interface {
+	name() string
+	write(w *bufio.Writer)
+}
+
+// Registry holds metric families and renders them in Prometheus text exposition format.
+type Registry struct {
+	mu         sync.Mutex
+	collectors map[string]collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		collectors: make(map[string]collector),
+	}
+}
+
+// register returns already registered collector with the same name if there is one.
+func (r *Registry) register(c collector) collector {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if existing, ok := r.collectors[c.name()]; ok {
+		return existing
+	}
+	r.collectors[c.name()] = c
+	return c
+}
+
+// WriteTo writes all metrics sorted by name.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.collectors))
+	for name := range r.collectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	collectors := make([]collector, len(names))
+	for i, name := range names {
+		collectors[i] = r.collectors[name]
+	}
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, c := range collectors {
+		c.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// Handler serves metrics, typically mounted on /metrics.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_, _ = r.WriteTo(w)
+	})
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+type family struct {
+	familyName string
+	help       string
+	labelNames []string
+
+	mu       sync.Mutex
+	children map[string][]string
+}
+
+func newFamily(name string, help string, labelNames []string) family {
+	return family{
+		familyName: name,
+		help:       help,
+		labelNames: labelNames,
+		children:   make(map[string][]string),
+	}
+}
+
+func (f *family) name() string {
+	return f.familyName
+}
+
+func (f *family) key(labelValues []string) string {
+	if len(labelValues) != len(f.labelNames) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.familyName, len(f.labelNames), len(labelValues)))
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+func (f *family) writeHeader(w *bufio.Writer, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", f.familyName, f.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.familyName, typ)
+}
+
+// sortedKeys returns children keys in stable order, must be called under f.mu.
+func (f *family) sortedKeys() []string {
+	keys := make([]string, 0, len(f.children))
+	for key := range f.children {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatLabels(names []string, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString("=")
+		writeLabelValue(&b, values[i])
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+		b.WriteString(extra[i])
+		b.WriteString("=")
+		writeLabelValue(&b, extra[i+1])
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// writeLabelValue writes quoted label value, escaping only backslash, double quote and
+// line feed as the text format requires. Invalid UTF-8 is replaced with U+FFFD.
+func writeLabelValue(b *strings.Builder, value string) {
+	b.WriteByte('"')
+	for _, r := range strings.ToValidUTF8(value, "\uFFFD") {
+		switch r {
+		case '\\':
+			b.WriteString(`\\`)
+		case '"':
+			b.WriteString(`\"`)
+		case '\n':
+			b.WriteString(`\n`)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	value uint64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+func (c *Counter) Add(delta uint64) {
+	atomic.AddUint64(&c.value, delta)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+// CounterVec is a family of counters partitioned by label values.
+type CounterVec struct {
+	family
+	counters map[string]*Counter
+}
+
+func (r *Registry) NewCounterVec(name string, help string, labelNames ...string) *CounterVec {
+	return r.register(&CounterVec{
+		family:   newFamily(name, help, labelNames),
+		counters: make(map[string]*Counter),
+	}).(*CounterVec)
+}
+
+func (v *CounterVec) WithLabelValues(labelValues ...string) *Counter {
+	key := v.key(labelValues)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	counter, ok := v.counters[key]
+	if !ok {
+		counter = &Counter{}
+		v.counters[key] = counter
+		v.children[key] = append([]string(nil), labelValues...)
+	}
+	return counter
+}
+
+func (v *CounterVec) write(w *bufio.Writer) {
+	v.writeHeader(w, "counter")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, key := range v.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %d\n", v.familyName, formatLabels(v.labelNames, v.children[key]), v.counters[key].Value())
+	}
+}
+
+// HistogramVec is a family of histograms partitioned by label values.
+// Observed values are divided by unit on output, e.g. 1e9 to expose nanoseconds as seconds.
+// Histograms keep fine-grained buckets for Quantile, but are exposed with fixed buckets
+// upper bounds (in output units), so every series has the same small set of buckets.
+type HistogramVec struct {
+	family
+	unit       float64
+	buckets    []float64
+	histograms map[string]*Histogram
+}
+
+// NewHistogramVec registers histogram family exposed with given sorted buckets upper bounds.
+// As observed values are bucketed with ~6% precision, values slightly below a bound
+// may be counted in the next bucket.
+func (r *Registry) NewHistogramVec(name string, help string, unit float64, buckets []float64, labelNames ...string) *HistogramVec {
+	if !sort.Float64sAreSorted(buckets) {
+		panic(fmt.Sprintf("metrics: %s buckets are not sorted", name))
+	}
+	return r.register(&HistogramVec{
+		family:     newFamily(name, help, labelNames),
+		unit:       unit,
+		buckets:    buckets,
+		histograms: make(map[string]*Histogram),
+	}).(*HistogramVec)
+}
+
+// ExponentialBuckets returns count buckets upper bounds, starting with start and multiplied by factor.
+func ExponentialBuckets(start float64, factor float64, count int) []float64 {
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start
+		start *= factor
+	}
+	return buckets
+}
+
+func (v *HistogramVec) WithLabelValues(labelValues ...string) *Histogram {
+	key := v.key(labelValues)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	histogram, ok := v.histograms[key]
+	if !ok {
+		histogram = &Histogram{}
+		v.histograms[key] = histogram
+		v.children[key] = append([]string(nil), labelValues...)
+	}
+	return histogram
+}
+
+// bucketCounts folds h buckets into v.buckets, the last count is for values above all of them.
+func (v *HistogramVec) bucketCounts(h *Histogram) []uint64 {
+	counts := make([]uint64, len(v.buckets)+1)
+	bucket := 0
+	for i := range h.counts {
+		count := atomic.LoadUint64(&h.counts[i])
+		if count == 0 {
+			continue
+		}
+		upper := float64(bucketUpperBound(i)) / v.unit
+		for bucket < len(v.buckets) && v.buckets[bucket] < upper {
+			bucket++
+		}
+		counts[bucket] += count
+	}
+	return counts
+}
+
+func (v *HistogramVec) write(w *bufio.Writer) {
+	v.writeHeader(w, "histogram")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, key := range v.sortedKeys() {
+		h := v.histograms[key]
+		labelValues := v.children[key]
+		counts := v.bucketCounts(h)
+		var cumulative uint64
+		for i, bound := range v.buckets {
+			cumulative += counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.familyName, formatLabels(v.labelNames, labelValues, "le", formatFloat(bound)), cumulative)
+		}
+		cumulative += counts[len(v.buckets)]
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.familyName, formatLabels(v.labelNames, labelValues, "le", "+Inf"), cumulative)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.familyName, formatLabels(v.labelNames, labelValues), formatFloat(float64(atomic.LoadUint64(&h.sum))/v.unit))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.familyName, formatLabels(v.labelNames, labelValues), cumulative)
+	}
+}
+
+// Sample is a single gauge value with its label values.
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// GaugeFunc is a family of gauges whose values are collected on each scrape.
+type GaugeFunc struct {
+	family
+	collect func() []Sample
+}
+
+// NewGaugeFunc registers gauge family, re-registering it replaces collect function.
+func (r *Registry) NewGaugeFunc(name string, help string, labelNames []string, collect func() []Sample) *GaugeFunc {
+	gauge := r.register(&GaugeFunc{
+		family: newFamily(name, help, labelNames),
+	}).(*GaugeFunc)
+	gauge.mu.Lock()
+	gauge.collect = collect
+	gauge.mu.Unlock()
+	return gauge
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+	g.writeHeader(w, "gauge")
+	g.mu.Lock()
+	collect := g.collect
+	g.mu.Unlock()
+	for _, sample := range collect() {
+		g.key(sample.LabelValues)
+		fmt.Fprintf(w, "%s%s %s\n", g.familyName, formatLabels(g.labelNames, sample.LabelValues), formatFloat(sample.Value))
+	}
+}
@@ -0,0 +1,215 @@
+package natsprober
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+// CaptureMode decides what is kept of message payload.
+type CaptureMode int
+
+const (
+	// CaptureFull keeps the whole payload.
+	CaptureFull CaptureMode = iota
+	// CaptureNone drops the payload.
+	CaptureNone
+	// CaptureTruncate keeps the first MaxBytes of the payload.
+	CaptureTruncate
+	// CaptureHash drops the payload keeping only its SHA-256 in PayloadHash.
+	CaptureHash
+)
+
+const redactedValue = "***"
+
+var captureModes = []CaptureMode{CaptureFull, CaptureNone, CaptureTruncate, CaptureHash}
+
+func (mode CaptureMode) String() string {
+	switch mode {
+	case CaptureFull:
+		return "full"
+	case CaptureNone:
+		return "none"
+	case CaptureTruncate:
+		return "truncate"
+	case CaptureHash:
+		return "hash"
+	default:
+		return fmt.Sprintf("CaptureMode(%d)", int(mode))
+	}
+}
+
+// ParseCaptureMode parses capture mode from its String() form.
+func ParseCaptureMode(s string) (CaptureMode, error) {
+	for _, mode := range captureModes {
+		if mode.String() == s {
+			return mode, nil
+		}
+	}
+	return CaptureFull, fmt.Errorf("unknown capture mode '%s'", s)
+}
+
+// CapturePolicy limits what is kept of messages with subjects matching Subject pattern
+// before they are stored as pending or passed to handlers. Responses matched to requests
+// are captured according to their request subject, so that responses on reply subjects
+// (e.g. "_INBOX.>") get the policy of their service. Unmatched responses are looked up
+// by their own subject. Correlation keys are computed and responses are
+// validated before the policy is applied.
+//
+// Headers listed in DenyHeaders are removed. Values of JSON fields at dot-separated
+// RedactJSONFields paths are replaced with "***" (payloads that are not JSON are left as is),
+// as are matches of RedactPatterns in payload and header values. Mode is applied last,
+// PayloadHash is computed from the original payload.
+type CapturePolicy struct {
+	Subject          string
+	Mode             CaptureMode
+	MaxBytes         int
+	DenyHeaders      []string
+	RedactJSONFields []string
+	RedactPatterns   []*regexp.Regexp
+}
+
+func (prober *NatsProber) capturePolicy(subject string) *CapturePolicy {
+	for i := range prober.CapturePolicies {
+		if matchSubject(prober.CapturePolicies[i].Subject, subject) {
+			return &prober.CapturePolicies[i]
+		}
+	}
+	return nil
+}
+
+// capture applies capture policy matching message subject, once per message.
+// The original nats.Msg is left intact.
+func (prober *NatsProber) capture(message *NatsMessage) *NatsMessage {
+	return prober.captureAs(message, message.Msg.Subject)
+}
+
+// captureResponse applies capture policy matching subject of the request response is matched to.
+func (prober *NatsProber) captureResponse(request *NatsMessage, response *NatsMessage) *NatsMessage {
+	return prober.captureAs(response, request.Msg.Subject)
+}
+
+func (prober *NatsProber) captureAs(message *NatsMessage, subject string) *NatsMessage {
+	if message.captured {
+		return message
+	}
+	policy := prober.capturePolicy(subject)
+	if policy == nil {
+		return message
+	}
+
+	msg := *message.Msg
+	msg.Header = policy.captureHeader(msg.Header)
+	captured := *message
+	captured.Msg = &msg
+	captured.Size = message.payloadSize()
+	captured.captured = true
+
+	if policy.Mode == CaptureHash {
+		hash := sha256.Sum256(msg.Data)
+		captured.PayloadHash = hex.EncodeToString(hash[:])
+	}
+	switch policy.Mode {
+	case CaptureNone, CaptureHash:
+		msg.Data = nil
+		return &captured
+	}
+
+	msg.Data = policy.redactPayload(msg.Data)
+	if policy.Mode == CaptureTruncate && len(msg.Data) > policy.MaxBytes {
+		msg.Data = msg.Data[:policy.MaxBytes]
+	}
+	return &captured
+}
+
+func (policy *CapturePolicy) captureHeader(header nats.Header) nats.Header {
+	if len(header) == 0 || len(policy.DenyHeaders) == 0 && len(policy.RedactPatterns) == 0 {
+		return header
+	}
+	captured := make(nats.Header, len(header))
+	for name, values := range header {
+		if policy.denies(name) {
+			continue
+		}
+		redacted := make([]string, len(values))
+		for i, value := range values {
+			for _, pattern := range policy.RedactPatterns {
+				value = pattern.ReplaceAllString(value, redactedValue)
+			}
+			redacted[i] = value
+		}
+		captured[name] = redacted
+	}
+	return captured
+}
+
+func (policy *CapturePolicy) denies(header string) bool {
+	for _, denied := range policy.DenyHeaders {
+		if strings.EqualFold(denied, header) {
+			return true
+		}
+	}
+	return false
+}
+
+func (policy *CapturePolicy) redactPayload(data []byte) []byte {
+	if len(data) == 0 {
+		return data
+	}
+	if len(policy.RedactJSONFields) > 0 {
+		if value, err := decodeJSON(data); err == nil {
+			for _, path := range policy.RedactJSONFields {
+				redactJSONField(value, strings.Split(path, "."))
+			}
+			if redacted, err := json.Marshal(value); err == nil {
+				data = redacted
+			}
+		}
+	}
+	for _, pattern := range policy.RedactPatterns {
+		data = pattern.ReplaceAll(data, []byte(redactedValue))
+	}
+	return data
+}
+
+// decodeJSON decodes a single JSON value keeping numbers as json.Number,
+// so that they are encoded back without loss of precision.
+func decodeJSON(data []byte) (any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after JSON value")
+	}
+	return value, nil
+}
+
+// redactJSONField masks value at path, looking into every element of arrays on the way.
+func redactJSONField(value any, path []string) {
+	switch value := value.(type) {
+	case map[string]any:
+		field, ok := value[path[0]]
+		if !ok {
+			return
+		}
+		if len(path) == 1 {
+			value[path[0]] = redactedValue
+			return
+		}
+		redactJSONField(field, path[1:])
+	case []any:
+		for _, item := range value {
+			redactJSONField(item, path)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package natsprober
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestCaptureModes(t *testing.T) {
+	payload := []byte(`{"id": 1, "data": "abcdef"}`)
+	hash := sha256.Sum256(payload)
+	prober := &NatsProber{
+		CapturePolicies: []CapturePolicy{
+			{Subject: "svc.none", Mode: CaptureNone},
+			{Subject: "svc.truncate", Mode: CaptureTruncate, MaxBytes: 5},
+			{Subject: "svc.hash", Mode: CaptureHash},
+			{Subject: "svc.*", Mode: CaptureNone},
+		},
+	}
+
+	for subject, expected := range map[string]string{
+		"svc.none":     "",
+		"svc.truncate": `{"id"`,
+		"svc.hash":     "",
+		"svc.other":    "",
+		"other":        string(payload),
+	} {
+		original := newNatsMessage(&nats.Msg{Subject: subject, Data: payload}, "key")
+		captured := prober.capture(original)
+		if string(captured.Msg.Data) != expected {
+			t.Errorf("%s: wrong captured payload %q", subject, captured.Msg.Data)
+		}
+		if captured.payloadSize() != len(payload) {
+			t.Errorf("%s: wrong original size %d", subject, captured.payloadSize())
+		}
+		if string(original.Msg.Data) != string(payload) {
+			t.Errorf("%s: original message modified", subject)
+		}
+	}
+
+	captured := prober.capture(newNatsMessage(&nats.Msg{Subject: "svc.hash", Data: payload}, "key"))
+	if captured.PayloadHash != hex.EncodeToString(hash[:]) {
+		t.Errorf("Wrong payload hash %s", captured.PayloadHash)
+	}
+	if again := prober.capture(captured); again != captured {
+		t.Errorf("Capture policy applied twice")
+	}
+	if event := NewProbeEvent(OutcomeUnknown, nil, captured); event.ResponseSize != len(payload) || event.ResponsePayloadHash != captured.PayloadHash {
+		t.Errorf("Wrong event size %d and hash %s", event.ResponseSize, event.ResponsePayloadHash)
+	}
+}
+
+func TestCaptureRedaction(t *testing.T) {
+	prober := &NatsProber{
+		CapturePolicies: []CapturePolicy{{
+			Subject:          ">",
+			DenyHeaders:      []string{"authorization"},
+			RedactJSONFields: []string{"user.email", "cards.number", "missing.field"},
+			RedactPatterns:   []*regexp.Regexp{regexp.MustCompile(`secret-\w+`)},
+		}},
+	}
+	msg := &nats.Msg{
+		Subject: "svc",
+		Header: nats.Header{
+			"Authorization": []string{"Bearer token"},
+			"Trace":         []string{"id secret-abc"},
+		},
+		Data: []byte(`{"user":{"email":"a@b.c","name":"a"},"cards":[{"number":"1234"},{"number":"5678"}],"note":"secret-xyz"}`),
+	}
+
+	captured := prober.capture(newNatsMessage(msg, "key"))
+	expected := `{"cards":[{"number":"***"},{"number":"***"}],"note":"***","user":{"email":"***","name":"a"}}`
+	if string(captured.Msg.Data) != expected {
+		t.Errorf("Wrong redacted payload %s", captured.Msg.Data)
+	}
+	if captured.Msg.Header.Get("Authorization") != "" {
+		t.Errorf("Denied header kept")
+	}
+	if trace := captured.Msg.Header.Get("Trace"); trace != "id ***" {
+		t.Errorf("Wrong redacted header %s", trace)
+	}
+	if msg.Header.Get("Authorization") == "" || msg.Header.Get("Trace") != "id secret-abc" {
+		t.Errorf("Original headers modified")
+	}
+
+	numbers := prober.capture(newNatsMessage(&nats.Msg{Subject: "svc", Data: []byte(`{"id":12345678901234567890,"user":{"email":"a"}}`)}, "key"))
+	if string(numbers.Msg.Data) != `{"id":12345678901234567890,"user":{"email":"***"}}` {
+		t.Errorf("Numbers must be kept intact, got %s", numbers.Msg.Data)
+	}
+
+	plain := prober.capture(newNatsMessage(&nats.Msg{Subject: "svc", Data: []byte("not json secret-1")}, "key"))
+	if string(plain.Msg.Data) != "not json ***" {
+		t.Errorf("Wrong redacted plain payload %s", plain.Msg.Data)
+	}
+}
+
+func TestWorkerCapturesAfterValidation(t *testing.T) {
+	prober := &NatsProber{
+		RequestTimeoutSeconds:    10,
+		WorkerMaxPendingRequests: 10,
+		CapturePolicies:          []CapturePolicy{{Subject: ">", Mode: CaptureNone}},
+		Validators:               []SubjectValidator{{Subject: "svc", Validator: MaxSizeValidator{MaxBytes: 2}}},
+	}
+	var invalid []*NatsMessage
+	prober.SetInvalidResponseHandler(func(_ *NatsMessage, response *NatsMessage, _ error) {
+		invalid = append(invalid, response)
+	})
+	w := newTestWorker(prober)
+
+	now := time.Now()
+	w.handleRequest(prober.capture(testRequest("a", now)))
+	w.handleResponse(newNatsMessage(&nats.Msg{Subject: "a", Data: []byte("abc")}, "a"))
+
+	if len(invalid) != 1 {
+		t.Fatalf("Oversized response must be validated before capture")
+	}
+	if len(invalid[0].Msg.Data) != 0 || invalid[0].Size != 3 {
+		t.Errorf("Reported response must be captured, got %q of size %d", invalid[0].Msg.Data, invalid[0].Size)
+	}
+}
+
+func TestWorkerCapturesResponsesByRequestSubject(t *testing.T) {
+	prober := &NatsProber{
+		RequestTimeoutSeconds:    10,
+		WorkerMaxPendingRequests: 10,
+		CapturePolicies:          []CapturePolicy{{Subject: "svc.>", Mode: CaptureNone}},
+	}
+	var successful []*NatsMessage
+	prober.SetSuccessfulResponseHandler(func(_ *NatsMessage, response *NatsMessage) {
+		successful = append(successful, response)
+	})
+	w := newTestWorker(prober)
+
+	request := newNatsMessage(&nats.Msg{Subject: "svc.get", Reply: "_INBOX.a", Data: []byte("secret-req")}, "_INBOX.a")
+	w.handleRequest(prober.capture(request))
+	w.handleResponse(newNatsMessage(&nats.Msg{Subject: "_INBOX.a", Data: []byte("secret-resp")}, "_INBOX.a"))
+
+	if len(successful) != 1 {
+		t.Fatalf("Wrong successful responses count %d", len(successful))
+	}
+	if len(successful[0].Msg.Data) != 0 || successful[0].Size != 11 {
+		t.Errorf("Response must be captured by request policy, got %q of size %d", successful[0].Msg.Data, successful[0].Size)
+	}
+}
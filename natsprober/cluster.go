@@ -0,0 +1,401 @@
+package natsprober
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+const (
+	defaultClusterQueueGroup          = "nats-prober"
+	defaultClusterHeartbeatInterval   = time.Second
+	defaultClusterMemberTimeoutBeats  = 3
+	defaultClusterOrphanResponseGrace = time.Millisecond * 100
+	clusterHeaderPrefix               = "Prober-"
+	clusterKindHeader                 = clusterHeaderPrefix + "Kind"
+	clusterSubjectHeader              = clusterHeaderPrefix + "Subject"
+	clusterReplyHeader                = clusterHeaderPrefix + "Reply"
+	clusterReceivedAtHeader           = clusterHeaderPrefix + "Received-At"
+	clusterKeyHeader                  = clusterHeaderPrefix + "Key"
+	clusterCapturedSizeHeader         = clusterHeaderPrefix + "Captured-Size"
+	clusterPayloadHashHeader          = clusterHeaderPrefix + "Payload-Hash"
+	clusterKindRequest                = "request"
+	clusterKindResponse               = "response"
+)
+
+type clusterHeartbeat struct {
+	ID      string `json:"id"`
+	Leaving bool   `json:"leaving,omitempty"`
+}
+
+// cluster coordinates prober instances sharing ClusterSubject. Each correlation key
+// is owned by a single member chosen by rendezvous hashing of member IDs, the same
+// way keys are assigned to workers. Messages received for keys owned by other members
+// are forwarded to them with original subject, reply and receive time in headers.
+type cluster struct {
+	prober            *NatsProber
+	id                string
+	queueGroup        string
+	heartbeatInterval time.Duration
+	memberTimeout     time.Duration
+
+	mu           sync.RWMutex
+	lastSeen     map[string]time.Time
+	leaving      bool
+	members      []string
+	memberHashes []uint64
+
+	// Serializes migrations of pending requests
+	rebalanceMu sync.Mutex
+
+	heartbeatSub *nats.Subscription
+	forwardSub   *nats.Subscription
+	stopChan     chan bool
+	wg           sync.WaitGroup
+}
+
+// ValidateClusterInstanceID checks that id can be used as a single subject token.
+func ValidateClusterInstanceID(id string) error {
+	if strings.ContainsAny(id, ".*> \t\r\n") {
+		return fmt.Errorf("instance id '%s' must not contain '.', '*', '>' or whitespace", id)
+	}
+	return nil
+}
+
+func startCluster(prober *NatsProber) (*cluster, error) {
+	if err := ValidateClusterInstanceID(prober.ClusterInstanceID); err != nil {
+		return nil, err
+	}
+	c := &cluster{
+		prober:            prober,
+		id:                prober.ClusterInstanceID,
+		queueGroup:        prober.ClusterQueueGroup,
+		heartbeatInterval: prober.ClusterHeartbeatInterval,
+		memberTimeout:     prober.ClusterMemberTimeout,
+		lastSeen:          make(map[string]time.Time),
+		stopChan:          make(chan bool),
+	}
+	if len(c.id) == 0 {
+		c.id = nuid.Next()
+	}
+	if len(c.queueGroup) == 0 {
+		c.queueGroup = defaultClusterQueueGroup
+	}
+	if c.heartbeatInterval <= 0 {
+		c.heartbeatInterval = defaultClusterHeartbeatInterval
+	}
+	if c.memberTimeout <= 0 {
+		c.memberTimeout = c.heartbeatInterval * defaultClusterMemberTimeoutBeats
+	}
+	c.updateMembers()
+
+	var err error
+	if c.forwardSub, err = prober.natsConn.Subscribe(c.forwardSubject(c.id), c.handleForward); err != nil {
+		return nil, err
+	}
+	if c.heartbeatSub, err = prober.natsConn.Subscribe(prober.ClusterSubject+".heartbeat", c.handleHeartbeat); err != nil {
+		c.forwardSub.Unsubscribe()
+		return nil, err
+	}
+	c.publishHeartbeat()
+
+	c.wg.Add(1)
+	go c.run()
+	return c, nil
+}
+
+func (c *cluster) forwardSubject(id string) string {
+	return c.prober.ClusterSubject + ".forward." + id
+}
+
+func (c *cluster) run() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(c.heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.publishHeartbeat()
+			c.removeExpired()
+		case <-c.stopChan:
+			return
+		}
+	}
+}
+
+// stop leaves the cluster, migrating all pending requests to remaining members.
+func (c *cluster) stop() error {
+	c.stopChan <- true
+	c.wg.Wait()
+
+	c.mu.Lock()
+	c.leaving = true
+	c.updateMembers()
+	c.mu.Unlock()
+	c.publishHeartbeat()
+	c.rebalance()
+
+	var unsubErr error
+	if err := c.heartbeatSub.Unsubscribe(); err != nil {
+		unsubErr = err
+	}
+	if err := c.forwardSub.Unsubscribe(); err != nil {
+		unsubErr = err
+	}
+	// Requests forwarded to this instance before others noticed it's leaving
+	c.prober.handlersWg.Wait()
+	c.rebalance()
+	if err := c.prober.natsConn.Flush(); err != nil && unsubErr == nil {
+		unsubErr = err
+	}
+	return unsubErr
+}
+
+func (c *cluster) publishHeartbeat() {
+	c.mu.RLock()
+	data, _ := json.Marshal(&clusterHeartbeat{ID: c.id, Leaving: c.leaving})
+	c.mu.RUnlock()
+	if err := c.prober.natsConn.Publish(c.prober.ClusterSubject+".heartbeat", data); err != nil {
+		log.Printf("NatsProber: can't publish cluster heartbeat: %v", err)
+	}
+}
+
+func (c *cluster) handleHeartbeat(msg *nats.Msg) {
+	var heartbeat clusterHeartbeat
+	if err := json.Unmarshal(msg.Data, &heartbeat); err != nil || len(heartbeat.ID) == 0 || heartbeat.ID == c.id {
+		return
+	}
+
+	c.mu.Lock()
+	_, known := c.lastSeen[heartbeat.ID]
+	if heartbeat.Leaving {
+		delete(c.lastSeen, heartbeat.ID)
+	} else {
+		c.lastSeen[heartbeat.ID] = time.Now()
+	}
+	changed := known == heartbeat.Leaving
+	if changed {
+		c.updateMembers()
+	}
+	c.mu.Unlock()
+
+	if changed {
+		if heartbeat.Leaving {
+			log.Printf("NatsProber: cluster member '%s' left", heartbeat.ID)
+		} else {
+			log.Printf("NatsProber: cluster member '%s' joined", heartbeat.ID)
+		}
+		c.rebalance()
+	}
+}
+
+func (c *cluster) removeExpired() {
+	c.mu.Lock()
+	var expired []string
+	for id, lastSeen := range c.lastSeen {
+		if time.Since(lastSeen) >= c.memberTimeout {
+			expired = append(expired, id)
+			delete(c.lastSeen, id)
+		}
+	}
+	if len(expired) > 0 {
+		c.updateMembers()
+	}
+	c.mu.Unlock()
+
+	for _, id := range expired {
+		log.Printf("NatsProber: cluster member '%s' timed out", id)
+	}
+	if len(expired) > 0 {
+		c.rebalance()
+	}
+}
+
+// updateMembers must be called under mu write lock.
+func (c *cluster) updateMembers() {
+	members := make([]string, 0, len(c.lastSeen)+1)
+	if !c.leaving {
+		members = append(members, c.id)
+	}
+	for id := range c.lastSeen {
+		members = append(members, id)
+	}
+	sort.Strings(members)
+
+	c.members = members
+	c.memberHashes = make([]uint64, len(members))
+	for i, id := range members {
+		c.memberHashes[i] = keyHash(id)
+	}
+}
+
+func (c *cluster) memberIDs() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]string(nil), c.members...)
+}
+
+// owner returns ID of the member owning key and whether it's this instance.
+func (c *cluster) owner(key string) (string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if len(c.members) == 0 {
+		return c.id, true
+	}
+	owner := c.members[rendezvousOwner(keyHash(key), c.memberHashes)]
+	return owner, owner == c.id
+}
+
+// forward sends message to its owner, returning false if it's owned by this instance.
+func (c *cluster) forward(kind string, message *NatsMessage) bool {
+	owner, self := c.owner(message.Key)
+	if self {
+		return false
+	}
+	c.send(owner, kind, message)
+	return true
+}
+
+func (c *cluster) send(owner string, kind string, message *NatsMessage) {
+	header := make(nats.Header, len(message.Msg.Header)+5)
+	for name, values := range message.Msg.Header {
+		header[name] = values
+	}
+	header.Set(clusterKindHeader, kind)
+	header.Set(clusterSubjectHeader, message.Msg.Subject)
+	header.Set(clusterReplyHeader, message.Msg.Reply)
+	header.Set(clusterReceivedAtHeader, strconv.FormatInt(message.ReceivedAt.UnixNano(), 10))
+	header.Set(clusterKeyHeader, message.Key)
+	if message.captured {
+		// Capture policy was already applied, so that the owner doesn't apply it again
+		header.Set(clusterCapturedSizeHeader, strconv.Itoa(message.Size))
+		if len(message.PayloadHash) > 0 {
+			header.Set(clusterPayloadHashHeader, message.PayloadHash)
+		}
+	}
+
+	forwarded := &nats.Msg{
+		Subject: c.forwardSubject(owner),
+		Header:  header,
+		Data:    message.Msg.Data,
+	}
+	if err := c.prober.natsConn.PublishMsg(forwarded); err != nil {
+		log.Printf("NatsProber: can't forward %s to cluster member '%s': %v", kind, owner, err)
+		return
+	}
+	c.prober.metrics.observeForward(kind)
+}
+
+// handleForward passes forwarded message to local workers. It's never forwarded again,
+// even if membership views of instances differ for a moment.
+func (c *cluster) handleForward(msg *nats.Msg) {
+	c.prober.handlersWg.Add(1)
+	defer c.prober.handlersWg.Done()
+
+	receivedAt, err := strconv.ParseInt(msg.Header.Get(clusterReceivedAtHeader), 10, 64)
+	if err != nil {
+		log.Printf("NatsProber: ignoring malformed forwarded message: %v", err)
+		return
+	}
+	original := &nats.Msg{
+		Subject: msg.Header.Get(clusterSubjectHeader),
+		Reply:   msg.Header.Get(clusterReplyHeader),
+		Data:    msg.Data,
+	}
+	for name, values := range msg.Header {
+		if strings.HasPrefix(name, clusterHeaderPrefix) {
+			continue
+		}
+		if original.Header == nil {
+			original.Header = make(nats.Header)
+		}
+		original.Header[name] = values
+	}
+	message := &NatsMessage{
+		Msg:        original,
+		ReceivedAt: time.Unix(0, receivedAt),
+		Key:        msg.Header.Get(clusterKeyHeader),
+		Size:       len(msg.Data),
+	}
+	if size := msg.Header.Get(clusterCapturedSizeHeader); len(size) > 0 {
+		message.Size, _ = strconv.Atoi(size)
+		message.PayloadHash = msg.Header.Get(clusterPayloadHashHeader)
+		message.captured = true
+	}
+
+	switch msg.Header.Get(clusterKindHeader) {
+	case clusterKindRequest:
+		c.prober.enqueueRequest(message)
+	case clusterKindResponse:
+		c.prober.enqueueResponse(message)
+	}
+}
+
+// rebalance forwards pending requests and orphan responses owned by other members to them.
+// Responses gathered so far for migrated requests are not carried over.
+// Synthetic requests stay, as their responses only arrive to this instance.
+func (c *cluster) rebalance() {
+	c.rebalanceMu.Lock()
+	defer c.rebalanceMu.Unlock()
+
+	c.prober.workersMu.RLock()
+	defer c.prober.workersMu.RUnlock()
+
+	var moved, movedOrphans int
+	for _, w := range c.prober.workers {
+		entries := w.extract(c.movable)
+		for _, pending := range entries {
+			owner, _ := c.owner(pending.request.Key)
+			for _, request := range pending.requests() {
+				c.send(owner, clusterKindRequest, request)
+				c.prober.requestResolved(request)
+			}
+		}
+		moved += len(entries)
+
+		orphans := w.extractOrphans(c.movable)
+		for _, orphan := range orphans {
+			owner, _ := c.owner(orphan.Key)
+			c.send(owner, clusterKindResponse, orphan)
+		}
+		movedOrphans += len(orphans)
+	}
+	if moved > 0 || movedOrphans > 0 {
+		log.Printf("NatsProber: migrated %d pending requests and %d orphan responses to other cluster members", moved, movedOrphans)
+	}
+}
+
+// movable reports whether messages of key are owned by another member and can be migrated to it.
+func (c *cluster) movable(key string) bool {
+	if isSyntheticReply(key) {
+		return false
+	}
+	_, self := c.owner(key)
+	return !self
+}
+
+// ClusterMembers returns IDs of known instances in clustered mode, including this one.
+func (prober *NatsProber) ClusterMembers() []string {
+	if prober.cluster == nil {
+		return nil
+	}
+	return prober.cluster.memberIDs()
+}
+
+// orphanResponseGrace returns how long unmatched responses are held before being reported as unknown.
+func (prober *NatsProber) orphanResponseGrace() time.Duration {
+	if prober.OrphanResponseGrace > 0 || len(prober.ClusterSubject) == 0 {
+		return prober.OrphanResponseGrace
+	}
+	return defaultClusterOrphanResponseGrace
+}
@@ -0,0 +1,244 @@
+package natsprober
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+)
+
+func startTestClusterProber(t *testing.T, url string, id string, successful *int64, unknown *int64, configure ...func(prober *NatsProber)) *NatsProber {
+	nc, err := nats.Connect(url)
+	if err != nil {
+		t.Fatalf("Can't connect: %v", err)
+	}
+	t.Cleanup(nc.Close)
+
+	prober := &NatsProber{
+		RequestSubjects:          []string{"svc.>"},
+		ResponseSubjects:         []string{"reply.>"},
+		RequestTimeoutSeconds:    10,
+		WorkersCount:             2,
+		WorkerMaxPendingRequests: 1000,
+		ClusterSubject:           "prober.cluster",
+		ClusterInstanceID:        id,
+		ClusterHeartbeatInterval: time.Millisecond * 20,
+	}
+	for _, f := range configure {
+		f(prober)
+	}
+	prober.SetSuccessfulResponseHandler(func(*NatsMessage, *NatsMessage) { atomic.AddInt64(successful, 1) })
+	prober.SetUnknownResponseHandler(func(*NatsMessage) { atomic.AddInt64(unknown, 1) })
+	if err := prober.Start(nc); err != nil {
+		t.Fatalf("Can't start prober: %v", err)
+	}
+	return prober
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	deadline := time.Now().Add(time.Second * 5)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func pendingCount(prober *NatsProber) int64 {
+	var pending int64
+	for _, w := range prober.workersSnapshot() {
+		pending += atomic.LoadInt64(&w.pendingCount)
+	}
+	return pending
+}
+
+func pendingBytes(prober *NatsProber) int64 {
+	var bytes int64
+	for _, w := range prober.workersSnapshot() {
+		bytes += atomic.LoadInt64(&w.pendingBytes)
+	}
+	return bytes
+}
+
+func TestClusterOwnsEachKeyOnce(t *testing.T) {
+	server := natsserver.RunRandClientPortServer()
+	defer server.Shutdown()
+
+	var successfulA, successfulB, unknown int64
+	a := startTestClusterProber(t, server.ClientURL(), "a", &successfulA, &unknown)
+	defer a.Stop(context.Background())
+	b := startTestClusterProber(t, server.ClientURL(), "b", &successfulB, &unknown)
+	defer b.Stop(context.Background())
+	waitFor(t, "membership", func() bool {
+		return len(a.ClusterMembers()) == 2 && len(b.ClusterMembers()) == 2
+	})
+
+	nc, err := nats.Connect(server.ClientURL())
+	if err != nil {
+		t.Fatalf("Can't connect: %v", err)
+	}
+	defer nc.Close()
+
+	const count = 100
+	for i := 0; i < count; i++ {
+		reply := "reply." + strconv.Itoa(i)
+		if err := nc.PublishRequest("svc.echo", reply, nil); err != nil {
+			t.Fatalf("Can't publish: %v", err)
+		}
+		if err := nc.Publish(reply, nil); err != nil {
+			t.Fatalf("Can't publish: %v", err)
+		}
+	}
+
+	waitFor(t, "responses", func() bool {
+		return atomic.LoadInt64(&successfulA)+atomic.LoadInt64(&successfulB) >= count
+	})
+	time.Sleep(time.Millisecond * 200)
+	if total := atomic.LoadInt64(&successfulA) + atomic.LoadInt64(&successfulB); total != count {
+		t.Errorf("Wrong successful count %d, each key must be reported once", total)
+	}
+	if atomic.LoadInt64(&successfulA) == 0 || atomic.LoadInt64(&successfulB) == 0 {
+		t.Errorf("Keys must be split between instances, got %d and %d", successfulA, successfulB)
+	}
+	if n := atomic.LoadInt64(&unknown); n != 0 {
+		t.Errorf("Wrong unknown count %d", n)
+	}
+}
+
+func TestClusterMigratesPendingOnLeave(t *testing.T) {
+	server := natsserver.RunRandClientPortServer()
+	defer server.Shutdown()
+
+	var successfulA, successfulB, unknown int64
+	a := startTestClusterProber(t, server.ClientURL(), "a", &successfulA, &unknown)
+	defer a.Stop(context.Background())
+	b := startTestClusterProber(t, server.ClientURL(), "b", &successfulB, &unknown)
+	waitFor(t, "membership", func() bool {
+		return len(a.ClusterMembers()) == 2 && len(b.ClusterMembers()) == 2
+	})
+
+	nc, err := nats.Connect(server.ClientURL())
+	if err != nil {
+		t.Fatalf("Can't connect: %v", err)
+	}
+	defer nc.Close()
+
+	const count = 50
+	for i := 0; i < count; i++ {
+		if err := nc.PublishRequest("svc.slow", "reply."+strconv.Itoa(i), nil); err != nil {
+			t.Fatalf("Can't publish: %v", err)
+		}
+	}
+	waitFor(t, "pending requests", func() bool {
+		return pendingCount(a)+pendingCount(b) == count
+	})
+	if pendingCount(b) == 0 {
+		t.Fatalf("Instance must own some keys before leaving")
+	}
+
+	b.Stop(context.Background())
+	waitFor(t, "migration", func() bool {
+		return pendingCount(a) == count && len(a.ClusterMembers()) == 1
+	})
+
+	for i := 0; i < count; i++ {
+		if err := nc.Publish("reply."+strconv.Itoa(i), nil); err != nil {
+			t.Fatalf("Can't publish: %v", err)
+		}
+	}
+	waitFor(t, "responses", func() bool {
+		return atomic.LoadInt64(&successfulA) == count
+	})
+	if n := atomic.LoadInt64(&unknown); n != 0 {
+		t.Errorf("Wrong unknown count %d", n)
+	}
+}
+
+func TestClusterMigratesOrphansOnLeave(t *testing.T) {
+	server := natsserver.RunRandClientPortServer()
+	defer server.Shutdown()
+
+	longGrace := func(prober *NatsProber) {
+		prober.OrphanResponseGrace = time.Second * 10
+	}
+	var successfulA, successfulB, unknown int64
+	a := startTestClusterProber(t, server.ClientURL(), "a", &successfulA, &unknown, longGrace)
+	defer a.Stop(context.Background())
+	b := startTestClusterProber(t, server.ClientURL(), "b", &successfulB, &unknown, longGrace)
+	waitFor(t, "membership", func() bool {
+		return len(a.ClusterMembers()) == 2 && len(b.ClusterMembers()) == 2
+	})
+
+	nc, err := nats.Connect(server.ClientURL())
+	if err != nil {
+		t.Fatalf("Can't connect: %v", err)
+	}
+	defer nc.Close()
+
+	// Responses overtaking their requests are held as orphans by their owners
+	const count = 50
+	for i := 0; i < count; i++ {
+		if err := nc.Publish("reply."+strconv.Itoa(i), nil); err != nil {
+			t.Fatalf("Can't publish: %v", err)
+		}
+	}
+	waitFor(t, "orphan responses", func() bool {
+		return pendingBytes(a) > 0 && pendingBytes(b) > 0
+	})
+	time.Sleep(time.Millisecond * 100)
+
+	b.Stop(context.Background())
+	waitFor(t, "migration", func() bool {
+		return len(a.ClusterMembers()) == 1 && pendingBytes(b) == 0
+	})
+
+	for i := 0; i < count; i++ {
+		if err := nc.PublishRequest("svc.echo", "reply."+strconv.Itoa(i), nil); err != nil {
+			t.Fatalf("Can't publish: %v", err)
+		}
+	}
+	waitFor(t, "responses", func() bool {
+		return atomic.LoadInt64(&successfulA) == count
+	})
+	if n := atomic.LoadInt64(&unknown); n != 0 {
+		t.Errorf("Wrong unknown count %d", n)
+	}
+}
+
+func TestClusterIgnoresSyntheticRequestsOfOthers(t *testing.T) {
+	server := natsserver.RunRandClientPortServer()
+	defer server.Shutdown()
+
+	nc, err := nats.Connect(server.ClientURL())
+	if err != nil {
+		t.Fatalf("Can't connect: %v", err)
+	}
+	defer nc.Close()
+	if _, err := nc.Subscribe("svc.echo", func(msg *nats.Msg) { msg.Respond(nil) }); err != nil {
+		t.Fatalf("Can't subscribe: %v", err)
+	}
+
+	var successfulA, successfulB, unknown int64
+	a := startTestClusterProber(t, server.ClientURL(), "a", &successfulA, &unknown, func(prober *NatsProber) {
+		prober.SyntheticProbes = []SyntheticProbe{{Subject: "svc.echo", Rate: 100}}
+	})
+	defer a.Stop(context.Background())
+	b := startTestClusterProber(t, server.ClientURL(), "b", &successfulB, &unknown)
+	defer b.Stop(context.Background())
+
+	// Synthetic requests are delivered to either member by the request queue group
+	waitFor(t, "synthetic responses", func() bool {
+		return atomic.LoadInt64(&successfulA) >= 20
+	})
+	if n := pendingCount(b); n != 0 || atomic.LoadInt64(&successfulB) != 0 {
+		t.Errorf("Synthetic requests of other member must be ignored, got %d pending and %d successful", n, successfulB)
+	}
+	if n := atomic.LoadInt64(&unknown); n != 0 {
+		t.Errorf("Wrong unknown count %d", n)
+	}
+}
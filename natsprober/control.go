@@ -0,0 +1,73 @@
+package natsprober
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/nats-io/nats.go"
+)
+
+// ControlCommand is a JSON request accepted on ControlSubject, e.g.
+// {"command": "add_request_subject", "subject": "service.>"}.
+// Commands: add_request_subject, remove_request_subject,
+// add_response_subject, remove_response_subject and list_subjects.
+type ControlCommand struct {
+	Command string `json:"command"`
+	Subject string `json:"subject,omitempty"`
+}
+
+// ControlReply is the JSON reply to ControlCommand.
+type ControlReply struct {
+	Error            string   `json:"error,omitempty"`
+	RequestSubjects  []string `json:"request_subjects,omitempty"`
+	ResponseSubjects []string `json:"response_subjects,omitempty"`
+}
+
+func (prober *NatsProber) handleControl(msg *nats.Msg) {
+	prober.handlersWg.Add(1)
+	defer prober.handlersWg.Done()
+
+	reply := &ControlReply{}
+	var command ControlCommand
+	if err := json.Unmarshal(msg.Data, &command); err != nil {
+		reply.Error = fmt.Sprintf("can't parse command: %v", err)
+	} else if err := prober.executeControl(&command); err != nil {
+		reply.Error = err.Error()
+	} else {
+		log.Printf("NatsProber: control command '%s' '%s' executed", command.Command, command.Subject)
+	}
+	reply.RequestSubjects, reply.ResponseSubjects = prober.Subjects()
+
+	if len(msg.Reply) == 0 {
+		return
+	}
+	data, err := json.Marshal(reply)
+	if err != nil {
+		log.Printf("NatsProber: can't marshal control reply: %v", err)
+		return
+	}
+	if err := msg.Respond(data); err != nil {
+		log.Printf("NatsProber: can't send control reply: %v", err)
+	}
+}
+
+func (prober *NatsProber) executeControl(command *ControlCommand) error {
+	if command.Command != "list_subjects" && len(command.Subject) == 0 {
+		return fmt.Errorf("subject is not set")
+	}
+	switch command.Command {
+	case "add_request_subject":
+		return prober.AddRequestSubject(command.Subject)
+	case "remove_request_subject":
+		return prober.RemoveRequestSubject(command.Subject)
+	case "add_response_subject":
+		return prober.AddResponseSubject(command.Subject)
+	case "remove_response_subject":
+		return prober.RemoveResponseSubject(command.Subject)
+	case "list_subjects":
+		return nil
+	default:
+		return fmt.Errorf("unknown command '%s'", command.Command)
+	}
+}
@@ -0,0 +1,41 @@
+package natsprober
+
+import (
+	"context"
+	"testing"
+)
+
+func TestExecuteControlValidation(t *testing.T) {
+	prober := &NatsProber{}
+	if err := prober.executeControl(&ControlCommand{Command: "add_request_subject"}); err == nil {
+		t.Error("Command without subject accepted")
+	}
+	if err := prober.executeControl(&ControlCommand{Command: "reboot", Subject: "x"}); err == nil {
+		t.Error("Unknown command accepted")
+	}
+	if err := prober.executeControl(&ControlCommand{Command: "remove_request_subject", Subject: "x"}); err == nil {
+		t.Error("Removal of unknown subject succeeded")
+	}
+	if err := prober.executeControl(&ControlCommand{Command: "list_subjects"}); err != nil {
+		t.Errorf("list_subjects: %s", err)
+	}
+}
+
+func TestSubjectsBeforeStart(t *testing.T) {
+	prober := &NatsProber{}
+	if err := prober.AddRequestSubject("svc"); err == nil {
+		t.Error("Request subject added before start")
+	}
+	if err := prober.AddResponseSubject("_INBOX.>"); err == nil {
+		t.Error("Response subject added before start")
+	}
+	if requestSubjects, responseSubjects := prober.Subjects(); len(requestSubjects) != 0 || len(responseSubjects) != 0 {
+		t.Errorf("Wrong subjects %v %v", requestSubjects, responseSubjects)
+	}
+	if stats := prober.Stats(); stats.Pending != 0 {
+		t.Errorf("Wrong stats %+v", stats)
+	}
+	if err := prober.Stop(context.Background()); err != nil {
+		t.Errorf("Stop before start: %s", err)
+	}
+}
@@ -0,0 +1,88 @@
+package natsprober
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Correlator extracts keys that match responses to their requests.
+// Messages for which no key can be extracted are not correlated:
+// such requests are ignored and such responses are reported as unknown.
+// Messages on request subjects without reply subject are one-way publishes,
+// they never reach correlators (see SetPublishHandler).
+type Correlator interface {
+	RequestKey(request *nats.Msg) (string, bool)
+	ResponseKey(response *nats.Msg) (string, bool)
+}
+
+// ReplySubjectCorrelator matches responses by subject to the reply subject of requests.
+// This is the default, classic inbox-style request/reply correlation.
+type ReplySubjectCorrelator struct{}
+
+func (ReplySubjectCorrelator) RequestKey(request *nats.Msg) (string, bool) {
+	return request.Reply, true
+}
+
+func (ReplySubjectCorrelator) ResponseKey(response *nats.Msg) (string, bool) {
+	return response.Subject, true
+}
+
+// HeaderCorrelator matches messages by value of the given header (e.g. Nats-Msg-Id),
+// which must be copied to the response by the service.
+type HeaderCorrelator struct {
+	Header string
+}
+
+func (c HeaderCorrelator) RequestKey(request *nats.Msg) (string, bool) {
+	return c.key(request)
+}
+
+func (c HeaderCorrelator) ResponseKey(response *nats.Msg) (string, bool) {
+	return c.key(response)
+}
+
+func (c HeaderCorrelator) key(msg *nats.Msg) (string, bool) {
+	if msg.Header == nil {
+		return "", false
+	}
+	value := msg.Header.Get(c.Header)
+	return value, len(value) > 0
+}
+
+// JSONFieldCorrelator matches messages by value of a field in JSON body,
+// e.g. "id" for JSON-RPC. Path is dot-separated for nested objects ("meta.request_id").
+// Values are compared by their compacted JSON representation, so 1 and "1" differ.
+type JSONFieldCorrelator struct {
+	Path string
+}
+
+func (c JSONFieldCorrelator) RequestKey(request *nats.Msg) (string, bool) {
+	return c.key(request)
+}
+
+func (c JSONFieldCorrelator) ResponseKey(response *nats.Msg) (string, bool) {
+	return c.key(response)
+}
+
+func (c JSONFieldCorrelator) key(msg *nats.Msg) (string, bool) {
+	raw := json.RawMessage(msg.Data)
+	for _, field := range strings.Split(c.Path, ".") {
+		var object map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &object); err != nil {
+			return "", false
+		}
+		var ok bool
+		if raw, ok = object[field]; !ok {
+			return "", false
+		}
+	}
+
+	var compacted bytes.Buffer
+	if err := json.Compact(&compacted, raw); err != nil || compacted.String() == "null" {
+		return "", false
+	}
+	return compacted.String(), true
+}
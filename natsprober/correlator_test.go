@@ -0,0 +1,46 @@
+package natsprober
+
+import (
+	"testing"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestHeaderCorrelator(t *testing.T) {
+	c := HeaderCorrelator{Header: "Nats-Msg-Id"}
+	request := &nats.Msg{Subject: "svc", Header: nats.Header{"Nats-Msg-Id": []string{"42"}}}
+	response := &nats.Msg{Subject: "reply", Header: nats.Header{"Nats-Msg-Id": []string{"42"}}}
+	requestKey, ok := c.RequestKey(request)
+	if !ok || requestKey != "42" {
+		t.Errorf("Wrong request key %q", requestKey)
+	}
+	if responseKey, ok := c.ResponseKey(response); !ok || responseKey != requestKey {
+		t.Errorf("Wrong response key %q", responseKey)
+	}
+	if _, ok := c.ResponseKey(&nats.Msg{Subject: "reply"}); ok {
+		t.Error("Key extracted without header")
+	}
+}
+
+func TestJSONFieldCorrelator(t *testing.T) {
+	c := JSONFieldCorrelator{Path: "id"}
+	requestKey, ok := c.RequestKey(&nats.Msg{Data: []byte(`{"jsonrpc": "2.0", "method": "x", "id": "abc"}`)})
+	if !ok || requestKey != `"abc"` {
+		t.Errorf("Wrong request key %q", requestKey)
+	}
+	responseKey, ok := c.ResponseKey(&nats.Msg{Data: []byte(`{"id":"abc","result":1}`)})
+	if !ok || responseKey != requestKey {
+		t.Errorf("Wrong response key %q", responseKey)
+	}
+
+	nested := JSONFieldCorrelator{Path: "meta.request_id"}
+	if key, ok := nested.RequestKey(&nats.Msg{Data: []byte(`{"meta": {"request_id": 7}}`)}); !ok || key != "7" {
+		t.Errorf("Wrong nested key %q", key)
+	}
+
+	for _, data := range []string{`not json`, `{"id": null}`, `{"other": 1}`, `[1, 2]`} {
+		if key, ok := c.RequestKey(&nats.Msg{Data: []byte(data)}); ok {
+			t.Errorf("Key %q extracted from %s", key, data)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package natsprober
+
+import "container/heap"
+
+// deadlineHeap is a min-heap of pending requests ordered by deadline.
+// Requests keep their position in heapIndex to be removable in O(log n).
+type deadlineHeap []*pendingRequest
+
+func (h deadlineHeap) Len() int {
+	return len(h)
+}
+
+func (h deadlineHeap) Less(i, j int) bool {
+	return h[i].deadline.Before(h[j].deadline)
+}
+
+func (h deadlineHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIndex = i
+	h[j].heapIndex = j
+}
+
+func (h *deadlineHeap) Push(x any) {
+	pending := x.(*pendingRequest)
+	pending.heapIndex = len(*h)
+	*h = append(*h, pending)
+}
+
+func (h *deadlineHeap) Pop() any {
+	old := *h
+	n := len(old)
+	pending := old[n-1]
+	old[n-1] = nil
+	pending.heapIndex = -1
+	*h = old[:n-1]
+	return pending
+}
+
+func (h *deadlineHeap) add(pending *pendingRequest) {
+	heap.Push(h, pending)
+}
+
+func (h *deadlineHeap) remove(pending *pendingRequest) {
+	if pending.heapIndex >= 0 {
+		heap.Remove(h, pending.heapIndex)
+	}
+}
+
+// first returns request with the earliest deadline.
+func (h deadlineHeap) first() (*pendingRequest, bool) {
+	if len(h) == 0 {
+		return nil, false
+	}
+	return h[0], true
+}
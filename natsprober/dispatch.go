@@ -0,0 +1,100 @@
+package natsprober
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const defaultHandlerQueueSize = 1000
+
+// dispatcher runs handlers on its own goroutines, each with a bounded queue. Outcomes are
+// assigned to goroutines by correlation key, so outcomes of the same key are handled in order.
+type dispatcher struct {
+	prober *NatsProber
+	queues []chan func()
+	// Outcomes not handled because their queue was full, updated atomically
+	overflows uint64
+	wg        sync.WaitGroup
+
+	// Guards queues from being closed while outcomes are queued
+	mu      sync.RWMutex
+	stopped bool
+}
+
+func startDispatcher(prober *NatsProber) *dispatcher {
+	queueSize := prober.HandlerQueueSize
+	if queueSize == 0 {
+		queueSize = defaultHandlerQueueSize
+	}
+	d := &dispatcher{
+		prober: prober,
+		queues: make([]chan func(), prober.HandlerWorkers),
+	}
+	for i := range d.queues {
+		d.queues[i] = make(chan func(), queueSize)
+		d.wg.Add(1)
+		go d.run(d.queues[i])
+	}
+	return d
+}
+
+func (d *dispatcher) run(queue chan func()) {
+	defer d.wg.Done()
+	for handle := range queue {
+		handle()
+	}
+}
+
+// stop handles everything queued so far, outcomes dispatched afterwards
+// (e.g. from handlers still running) are handled synchronously.
+func (d *dispatcher) stop() {
+	d.mu.Lock()
+	d.stopped = true
+	for _, queue := range d.queues {
+		close(queue)
+	}
+	d.mu.Unlock()
+	d.wg.Wait()
+}
+
+func (d *dispatcher) backlog() int {
+	var backlog int
+	for _, queue := range d.queues {
+		backlog += len(queue)
+	}
+	return backlog
+}
+
+// dispatchKey returns key outcomes are ordered by: correlation key, or subject for messages without one.
+func dispatchKey(request *NatsMessage, response *NatsMessage) string {
+	message := request
+	if message == nil {
+		message = response
+	}
+	if len(message.Key) > 0 {
+		return message.Key
+	}
+	return message.Msg.Subject
+}
+
+// dispatch runs handle right away, or queues it if HandlerWorkers is set.
+func (prober *NatsProber) dispatch(outcome Outcome, key string, handle func()) {
+	d := prober.dispatcher
+	if d == nil {
+		handle()
+		return
+	}
+	d.mu.RLock()
+	if d.stopped {
+		d.mu.RUnlock()
+		handle()
+		return
+	}
+	defer d.mu.RUnlock()
+	select {
+	case d.queues[keyHash(key)%uint64(len(d.queues))] <- handle:
+	default:
+		atomic.AddUint64(&d.overflows, 1)
+		prober.metrics.observeHandlerOverflow(outcome)
+	}
+}
@@ -0,0 +1,106 @@
+package natsprober
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDispatcherOrderAndOverflow(t *testing.T) {
+	prober := &NatsProber{
+		RequestTimeoutSeconds:    10,
+		WorkerMaxPendingRequests: 10,
+		GatherResponses:          true,
+		HandlerWorkers:           2,
+		HandlerQueueSize:         2,
+	}
+	started := make(chan bool, 1)
+	unblock := make(chan bool)
+	ordinals := make(chan uint, 10)
+	prober.SetGatheredResponseHandler(func(_ *NatsMessage, _ *NatsMessage, ordinal uint) {
+		if ordinal == 1 {
+			started <- true
+			<-unblock
+		}
+		ordinals <- ordinal
+	})
+	prober.dispatcher = startDispatcher(prober)
+	w := newTestWorker(prober)
+
+	now := time.Now()
+	w.handleRequest(testRequest("a", now))
+	w.handleResponse(testResponse("a", now))
+	<-started
+	// Handler is blocked, matching must go on
+	for i := 0; i < 3; i++ {
+		w.handleResponse(testResponse("a", now))
+	}
+	if overflows := atomic.LoadUint64(&prober.dispatcher.overflows); overflows != 1 {
+		t.Errorf("Wrong overflows count %d", overflows)
+	}
+	if count := prober.counters.outcomes[OutcomeGatheredResponse]; count != 4 {
+		t.Errorf("Overflowed outcomes must still be counted, got %d", count)
+	}
+
+	close(unblock)
+	prober.dispatcher.stop()
+	close(ordinals)
+	var handled []uint
+	for ordinal := range ordinals {
+		handled = append(handled, ordinal)
+	}
+	if len(handled) != 3 || handled[0] != 1 || handled[1] != 2 || handled[2] != 3 {
+		t.Errorf("Wrong handled ordinals %v", handled)
+	}
+}
+
+func TestDispatchAfterStop(t *testing.T) {
+	prober := &NatsProber{
+		HandlerWorkers: 1,
+	}
+	handled := 0
+	prober.SetTimeoutedRequestHandler(func(*NatsMessage) {
+		handled++
+	})
+	prober.dispatcher = startDispatcher(prober)
+	prober.dispatcher.stop()
+
+	prober.reportTimeouted(testRequest("a", time.Now()))
+	if handled != 1 {
+		t.Errorf("Outcome dispatched after stop must be handled synchronously, got %d", handled)
+	}
+}
+
+func TestStopWithHandlerUsingProber(t *testing.T) {
+	prober := &NatsProber{
+		RequestTimeoutSeconds:    10,
+		WorkersCount:             2,
+		WorkerMaxPendingRequests: 10,
+	}
+	workers := -1
+	prober.SetAbandonedRequestHandler(func(*NatsMessage) {
+		workers = prober.CurrentWorkersCount()
+	})
+	prober.startWorkers()
+	prober.enqueueRequest(testRequest("a", time.Now()))
+
+	done := make(chan error)
+	go func() {
+		done <- prober.Stop(context.Background())
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Stop: %s", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("Stop deadlocked with handler using prober")
+	}
+	if workers != 0 {
+		t.Errorf("Wrong workers count %d seen by handler", workers)
+	}
+	// Messages of subscriptions that failed to unsubscribe are ignored
+	prober.enqueueRequest(testRequest("b", time.Now()))
+	prober.enqueueResponse(testResponse("b", time.Now()))
+}
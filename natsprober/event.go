@@ -0,0 +1,124 @@
+package natsprober
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+type Outcome string
+
+const (
+	OutcomeSuccessful Outcome = "successful"
+	OutcomeTimeouted  Outcome = "timeouted"
+	OutcomeUnknown    Outcome = "unknown"
+	OutcomeDropped    Outcome = "dropped"
+	OutcomeInvalid    Outcome = "invalid"
+	// Request answered by NATS status message, e.g. 503 no responders
+	OutcomeNoResponders Outcome = "no_responders"
+	// Request still pending when prober stopped
+	OutcomeAbandoned Outcome = "abandoned"
+	// Pending request replaced by a later request with the same key
+	OutcomeSuperseded Outcome = "superseded"
+	// Message on request subject without reply subject, not expecting any response
+	OutcomePublish Outcome = "publish"
+
+	OutcomeGatheredResponse Outcome = "gathered_response"
+	OutcomeGatherCompleted  Outcome = "gather_completed"
+)
+
+var outcomes = []Outcome{
+	OutcomeSuccessful, OutcomeTimeouted, OutcomeUnknown, OutcomeDropped, OutcomeInvalid,
+	OutcomeNoResponders, OutcomeAbandoned, OutcomeSuperseded, OutcomePublish,
+	OutcomeGatheredResponse, OutcomeGatherCompleted,
+}
+
+// ParseOutcome checks that s is a known outcome.
+func ParseOutcome(s string) (Outcome, error) {
+	for _, outcome := range outcomes {
+		if string(outcome) == s {
+			return outcome, nil
+		}
+	}
+	return "", fmt.Errorf("unknown outcome '%s'", s)
+}
+
+// GatherResult summarizes responses gathered for a single request.
+type GatherResult struct {
+	Responses    uint
+	FirstLatency time.Duration
+	LastLatency  time.Duration
+}
+
+// ProbeEvent is a flat description of a single prober outcome.
+// Response-related fields are left empty for outcomes without a response,
+// and request-related ones for unknown responses.
+type ProbeEvent struct {
+	Outcome Outcome
+
+	RequestSubject string
+	ReplySubject   string
+
+	RequestSize  int
+	ResponseSize int
+	// Set by CaptureHash policy
+	RequestPayloadHash  string
+	ResponsePayloadHash string
+	RequestHeaders      nats.Header
+	ResponseHeaders     nats.Header
+
+	RequestReceivedAt  time.Time
+	ResponseReceivedAt time.Time
+	Latency            time.Duration
+
+	// Ordinal of gathered response, starting from 1
+	Ordinal uint
+	// Number of responses and latency of the last one for completed gathers,
+	// Latency is the one of the first response in that case
+	Responses   uint
+	LastLatency time.Duration
+
+	// Set for dropped outcome
+	DropReason DropReason
+	// Set for invalid outcome
+	InvalidReason string
+	// NATS status code for no_responders outcome
+	Status int
+
+	// Set for requests of SyntheticProbes and responses to them
+	Synthetic bool
+
+	// Set by Pipeline stages, e.g. HeaderLabelsStage
+	Labels map[string]string
+}
+
+// NewProbeEvent builds event from request and response, any of which may be nil.
+func NewProbeEvent(outcome Outcome, request *NatsMessage, response *NatsMessage) *ProbeEvent {
+	event := &ProbeEvent{
+		Outcome: outcome,
+	}
+	if request != nil {
+		event.RequestSubject = request.Msg.Subject
+		event.ReplySubject = request.Msg.Reply
+		event.RequestSize = request.payloadSize()
+		event.RequestPayloadHash = request.PayloadHash
+		event.RequestHeaders = request.Msg.Header
+		event.RequestReceivedAt = request.ReceivedAt
+		event.Synthetic = request.Synthetic
+	}
+	if response != nil {
+		if request == nil {
+			event.ReplySubject = response.Msg.Subject
+		}
+		event.ResponseSize = response.payloadSize()
+		event.ResponsePayloadHash = response.PayloadHash
+		event.ResponseHeaders = response.Msg.Header
+		event.ResponseReceivedAt = response.ReceivedAt
+		event.Synthetic = event.Synthetic || response.Synthetic
+	}
+	if request != nil && response != nil {
+		event.Latency = response.ReceivedAt.Sub(request.ReceivedAt)
+	}
+	return event
+}
@@ -0,0 +1,238 @@
+package natsprober
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	defaultResponseSubscriptionExpiry = time.Minute
+	defaultInboxPrefix                = "_INBOX"
+)
+
+// inboxTracker subscribes to response subjects derived from reply subjects of observed requests.
+// Each pending request holds a reference on its inbox subscription, subscriptions
+// without references are removed after expiry.
+type inboxTracker struct {
+	prober *NatsProber
+	expiry time.Duration
+
+	// Subscription covering all single-token inboxes, made ahead of requests
+	singleTokenPattern string
+	singleTokenSub     *nats.Subscription
+
+	mu      sync.Mutex
+	inboxes map[string]*trackedInbox
+	stopped bool
+
+	stopChan chan bool
+	wg       sync.WaitGroup
+}
+
+type trackedInbox struct {
+	sub       *nats.Subscription
+	refs      int
+	idleSince time.Time
+}
+
+func startInboxTracker(prober *NatsProber) (*inboxTracker, error) {
+	prefix := prober.AutoResponseInboxPrefix
+	if len(prefix) == 0 {
+		prefix = defaultInboxPrefix
+	}
+	t := &inboxTracker{
+		prober:             prober,
+		expiry:             prober.ResponseSubscriptionExpiry,
+		singleTokenPattern: prefix + ".*",
+		inboxes:            make(map[string]*trackedInbox),
+		stopChan:           make(chan bool),
+	}
+	if t.expiry <= 0 {
+		t.expiry = defaultResponseSubscriptionExpiry
+	}
+
+	if err := t.updateCoverage(); err != nil {
+		return nil, err
+	}
+
+	t.wg.Add(1)
+	go t.run()
+	return t, nil
+}
+
+// updateCoverage unsubscribes from inboxes covered by response subjects, so that responses
+// aren't received twice. A single-token inbox can't be subscribed to before its only response
+// may arrive, so they are subscribed to ahead whenever response subjects don't cover them.
+func (t *inboxTracker) updateCoverage() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped {
+		return nil
+	}
+
+	covered := t.prober.responseSubs.covers(t.singleTokenPattern)
+	if covered && t.singleTokenSub != nil {
+		if err := t.singleTokenSub.Unsubscribe(); err != nil {
+			return err
+		}
+		t.singleTokenSub = nil
+	} else if !covered && t.singleTokenSub == nil {
+		sub, err := t.prober.subscribe(t.singleTokenPattern, t.prober.handleResponse)
+		if err != nil {
+			return err
+		}
+		if err := t.prober.natsConn.Flush(); err != nil {
+			sub.Unsubscribe()
+			return err
+		}
+		t.singleTokenSub = sub
+	}
+
+	// Requests holding references on removed inboxes release them as no-op
+	for pattern, inbox := range t.inboxes {
+		if !t.prober.responseSubs.covers(pattern) {
+			continue
+		}
+		if err := inbox.sub.Unsubscribe(); err != nil {
+			log.Printf("NatsProber: can't unsubscribe from response subject '%s': %v", pattern, err)
+		}
+		delete(t.inboxes, pattern)
+	}
+	return nil
+}
+
+// responseSubjectPattern returns subscription subject that covers given reply subject
+// and replies to other requests made by the same client. For muxed inboxes
+// ("_INBOX.<nuid>.<token>") that's "_INBOX.<nuid>.*", replies of two tokens or less
+// are considered unique and are subscribed to as is.
+func responseSubjectPattern(reply string) string {
+	if strings.Count(reply, ".") < 2 {
+		return reply
+	}
+	return reply[:strings.LastIndexByte(reply, '.')] + ".*"
+}
+
+func (t *inboxTracker) acquire(reply string) {
+	if len(reply) == 0 {
+		return
+	}
+	pattern := responseSubjectPattern(reply)
+	if matchSubject(t.singleTokenPattern, pattern) || t.prober.responseSubs.covers(pattern) {
+		return
+	}
+	if t.track(pattern) {
+		// Make sure the subscription is in place before the request is handed to workers,
+		// narrowing the window in which its response can be missed
+		if err := t.prober.natsConn.Flush(); err != nil {
+			log.Printf("NatsProber: can't flush subscription to response subject '%s': %v", pattern, err)
+		}
+	}
+}
+
+// track adds a reference to inbox subscription, reporting whether it was just made.
+func (t *inboxTracker) track(pattern string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped {
+		return false
+	}
+	if inbox, ok := t.inboxes[pattern]; ok {
+		inbox.refs++
+		return false
+	}
+	sub, err := t.prober.subscribe(pattern, t.prober.handleResponse)
+	if err != nil {
+		log.Printf("NatsProber: can't subscribe to response subject '%s': %v", pattern, err)
+		return false
+	}
+	t.inboxes[pattern] = &trackedInbox{sub: sub, refs: 1}
+	return true
+}
+
+func (t *inboxTracker) release(reply string) {
+	if len(reply) == 0 {
+		return
+	}
+	pattern := responseSubjectPattern(reply)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if inbox, ok := t.inboxes[pattern]; ok && inbox.refs > 0 {
+		inbox.refs--
+		if inbox.refs == 0 {
+			inbox.idleSince = time.Now()
+		}
+	}
+}
+
+func (t *inboxTracker) subjects() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	subjects := make([]string, 0, len(t.inboxes)+1)
+	if t.singleTokenSub != nil {
+		subjects = append(subjects, t.singleTokenPattern)
+	}
+	for pattern := range t.inboxes {
+		subjects = append(subjects, pattern)
+	}
+	sort.Strings(subjects)
+	return subjects
+}
+
+func (t *inboxTracker) run() {
+	defer t.wg.Done()
+
+	ticker := time.NewTicker(t.expiry / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			t.removeExpired()
+		case <-t.stopChan:
+			return
+		}
+	}
+}
+
+func (t *inboxTracker) removeExpired() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for pattern, inbox := range t.inboxes {
+		if inbox.refs > 0 || time.Since(inbox.idleSince) < t.expiry {
+			continue
+		}
+		if err := inbox.sub.Unsubscribe(); err != nil {
+			log.Printf("NatsProber: can't unsubscribe from response subject '%s': %v", pattern, err)
+		}
+		delete(t.inboxes, pattern)
+	}
+}
+
+// stop unsubscribes from all tracked inboxes.
+func (t *inboxTracker) stop() error {
+	t.stopChan <- true
+	t.wg.Wait()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stopped = true
+	var unsubErr error
+	if t.singleTokenSub != nil {
+		if err := t.singleTokenSub.Unsubscribe(); err != nil {
+			unsubErr = err
+		}
+	}
+	for pattern, inbox := range t.inboxes {
+		if err := inbox.sub.Unsubscribe(); err != nil {
+			unsubErr = err
+		}
+		delete(t.inboxes, pattern)
+	}
+	return unsubErr
+}
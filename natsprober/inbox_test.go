@@ -0,0 +1,16 @@
+package natsprober
+
+import "testing"
+
+func TestResponseSubjectPattern(t *testing.T) {
+	for reply, pattern := range map[string]string{
+		"_INBOX.abc.1":        "_INBOX.abc.*",
+		"_INBOX.abc.def.2":    "_INBOX.abc.def.*",
+		"_INBOX.abc":          "_INBOX.abc",
+		"_INBOX_custom.abc.3": "_INBOX_custom.abc.*",
+	} {
+		if actual := responseSubjectPattern(reply); actual != pattern {
+			t.Errorf("responseSubjectPattern(%q) = %q, expected %q", reply, actual, pattern)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package natsprober
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+)
+
+// JSONSchemaValidator requires response data to be JSON conforming to a schema.
+// Supported subset of JSON Schema keywords: type, enum, properties, required,
+// additionalProperties (boolean only), items, minimum, maximum, minLength, maxLength
+// and pattern. Annotations ($schema, $id, $comment, title, description, default, examples)
+// are allowed, schemas with any other keyword are rejected rather than accepting payloads
+// they were meant to reject. Patterns use RE2 syntax rather than ECMA-262, so lookarounds
+// and backreferences are rejected as well.
+type JSONSchemaValidator struct {
+	schema *jsonSchema
+}
+
+type jsonSchema struct {
+	Type                 json.RawMessage        `json:"type"`
+	Enum                 []any                  `json:"enum"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties *bool                  `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	Pattern              string                 `json:"pattern"`
+
+	types   []string
+	pattern *regexp.Regexp
+}
+
+var jsonSchemaKeywords = map[string]bool{
+	"type": true, "enum": true, "properties": true, "required": true, "additionalProperties": true,
+	"items": true, "minimum": true, "maximum": true, "minLength": true, "maxLength": true, "pattern": true,
+
+	"$schema": true, "$id": true, "$comment": true, "title": true, "description": true,
+	"default": true, "examples": true,
+}
+
+func (schema *jsonSchema) UnmarshalJSON(data []byte) error {
+	var keywords map[string]json.RawMessage
+	if err := json.Unmarshal(data, &keywords); err != nil {
+		return err
+	}
+	for keyword := range keywords {
+		if !jsonSchemaKeywords[keyword] {
+			return fmt.Errorf("unsupported JSON schema keyword '%s'", keyword)
+		}
+	}
+	// Alias type doesn't have UnmarshalJSON, avoiding recursion
+	type plain jsonSchema
+	return json.Unmarshal(data, (*plain)(schema))
+}
+
+// NewJSONSchemaValidator parses schema document.
+func NewJSONSchemaValidator(schema []byte) (*JSONSchemaValidator, error) {
+	var root jsonSchema
+	if err := json.Unmarshal(schema, &root); err != nil {
+		return nil, fmt.Errorf("can't parse JSON schema: %v", err)
+	}
+	if err := root.compile(); err != nil {
+		return nil, err
+	}
+	return &JSONSchemaValidator{schema: &root}, nil
+}
+
+func (schema *jsonSchema) compile() error {
+	if len(schema.Type) > 0 {
+		var single string
+		if err := json.Unmarshal(schema.Type, &single); err == nil {
+			schema.types = []string{single}
+		} else if err := json.Unmarshal(schema.Type, &schema.types); err != nil {
+			return fmt.Errorf("JSON schema type must be a string or an array of strings")
+		}
+	}
+	if len(schema.Pattern) > 0 {
+		var err error
+		if schema.pattern, err = regexp.Compile(schema.Pattern); err != nil {
+			return fmt.Errorf("JSON schema pattern: %v", err)
+		}
+	}
+	for _, property := range schema.Properties {
+		if err := property.compile(); err != nil {
+			return err
+		}
+	}
+	if schema.Items != nil {
+		return schema.Items.compile()
+	}
+	return nil
+}
+
+func (v *JSONSchemaValidator) Validate(_ *NatsMessage, response *NatsMessage) error {
+	var value any
+	if err := json.Unmarshal(response.Msg.Data, &value); err != nil {
+		return fmt.Errorf("malformed JSON: %v", err)
+	}
+	return v.schema.validate(value, "$")
+}
+
+func (schema *jsonSchema) validate(value any, path string) error {
+	if len(schema.types) > 0 && !schema.matchesType(value) {
+		return fmt.Errorf("%s: %s is not of type %v", path, jsonTypeName(value), schema.types)
+	}
+	if len(schema.Enum) > 0 {
+		found := false
+		for _, allowed := range schema.Enum {
+			if reflect.DeepEqual(value, allowed) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: value is not one of enum", path)
+		}
+	}
+
+	switch value := value.(type) {
+	case string:
+		length := utf8.RuneCountInString(value)
+		if schema.MinLength != nil && length < *schema.MinLength {
+			return fmt.Errorf("%s: string is shorter than %d", path, *schema.MinLength)
+		}
+		if schema.MaxLength != nil && length > *schema.MaxLength {
+			return fmt.Errorf("%s: string is longer than %d", path, *schema.MaxLength)
+		}
+		if schema.pattern != nil && !schema.pattern.MatchString(value) {
+			return fmt.Errorf("%s: string doesn't match /%s/", path, schema.Pattern)
+		}
+	case float64:
+		if schema.Minimum != nil && value < *schema.Minimum {
+			return fmt.Errorf("%s: %v is less than %v", path, value, *schema.Minimum)
+		}
+		if schema.Maximum != nil && value > *schema.Maximum {
+			return fmt.Errorf("%s: %v is greater than %v", path, value, *schema.Maximum)
+		}
+	case map[string]any:
+		for _, name := range schema.Required {
+			if _, ok := value[name]; !ok {
+				return fmt.Errorf("%s: required property '%s' is missing", path, name)
+			}
+		}
+		names := make([]string, 0, len(value))
+		for name := range value {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			property, ok := schema.Properties[name]
+			if !ok {
+				if schema.AdditionalProperties != nil && !*schema.AdditionalProperties {
+					return fmt.Errorf("%s: additional property '%s' is not allowed", path, name)
+				}
+				continue
+			}
+			if err := property.validate(value[name], path+"."+name); err != nil {
+				return err
+			}
+		}
+	case []any:
+		if schema.Items != nil {
+			for i, item := range value {
+				if err := schema.Items.validate(item, path+"["+strconv.Itoa(i)+"]"); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (schema *jsonSchema) matchesType(value any) bool {
+	actual := jsonTypeName(value)
+	for _, expected := range schema.types {
+		if expected == actual {
+			return true
+		}
+		if expected == "number" && actual == "integer" {
+			return true
+		}
+	}
+	return false
+}
+
+func jsonTypeName(value any) string {
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if value == math.Trunc(value) {
+			return "integer"
+		}
+		return "number"
+	case []any:
+		return "array"
+	default:
+		return "object"
+	}
+}
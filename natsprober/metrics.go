@@ -0,0 +1,290 @@
+package natsprober
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aurora-is-near/nats-prober/metrics"
+)
+
+const (
+	defaultMetricsMaxSubjects = 100
+
+	// otherSubjectLabel replaces subjects beyond MetricsMaxSubjects in metrics labels.
+	otherSubjectLabel = "_other"
+)
+
+var (
+	// Latency buckets from 500us to ~33s
+	latencyBuckets = metrics.ExponentialBuckets(0.0005, 2, 17)
+	// Size buckets from 64 bytes to 16MiB
+	sizeBuckets = metrics.ExponentialBuckets(64, 4, 10)
+)
+
+type proberMetrics struct {
+	subjects subjectLabels
+
+	outcomes *metrics.CounterVec
+	latency  *metrics.HistogramVec
+	drops    *metrics.CounterVec
+	rejects  *metrics.CounterVec
+	forwards *metrics.CounterVec
+	statuses *metrics.CounterVec
+
+	publishBytes *metrics.CounterVec
+	publishSizes *metrics.HistogramVec
+
+	handlerOverflows *metrics.CounterVec
+	subscriberDrops  *metrics.CounterVec
+}
+
+func (prober *NatsProber) startMetrics() {
+	if prober.Metrics == nil {
+		return
+	}
+
+	maxSubjects := prober.MetricsMaxSubjects
+	if maxSubjects == 0 {
+		maxSubjects = defaultMetricsMaxSubjects
+	}
+	prober.metrics = &proberMetrics{
+		subjects: subjectLabels{max: int(maxSubjects)},
+		outcomes: prober.Metrics.NewCounterVec(
+			"nats_prober_outcomes_total",
+			"Number of prober outcomes by request subject.",
+			"outcome", "subject", "synthetic",
+		),
+		latency: prober.Metrics.NewHistogramVec(
+			"nats_prober_latency_seconds",
+			"Latency between request and its response by request subject.",
+			float64(time.Second),
+			latencyBuckets,
+			"subject", "synthetic",
+		),
+		drops: prober.Metrics.NewCounterVec(
+			"nats_prober_drops_total",
+			"Number of dropped messages by reason.",
+			"reason",
+		),
+		rejects: prober.Metrics.NewCounterVec(
+			"nats_prober_rejected_requests_total",
+			"Number of requests rejected by reject drop policy by request subject.",
+			"subject",
+		),
+		statuses: prober.Metrics.NewCounterVec(
+			"nats_prober_status_responses_total",
+			"Number of requests answered by NATS status messages (e.g. 503 no responders) by request subject and status.",
+			"subject", "status",
+		),
+		publishBytes: prober.Metrics.NewCounterVec(
+			"nats_prober_publish_bytes_total",
+			"Payload bytes of one-way publishes (without reply subject) by subject.",
+			"subject",
+		),
+		publishSizes: prober.Metrics.NewHistogramVec(
+			"nats_prober_publish_size_bytes",
+			"Payload sizes of one-way publishes by subject.",
+			1,
+			sizeBuckets,
+			"subject",
+		),
+		handlerOverflows: prober.Metrics.NewCounterVec(
+			"nats_prober_handler_overflows_total",
+			"Number of outcomes not passed to handlers due to full dispatch queues by outcome.",
+			"outcome",
+		),
+		subscriberDrops: prober.Metrics.NewCounterVec(
+			"nats_prober_subscriber_drops_total",
+			"Number of events dropped due to full subscriber buffers by outcome.",
+			"outcome",
+		),
+		forwards: prober.Metrics.NewCounterVec(
+			"nats_prober_forwarded_total",
+			"Number of messages forwarded to other cluster members by kind.",
+			"kind",
+		),
+	}
+
+	prober.Metrics.NewGaugeFunc(
+		"nats_prober_workers",
+		"Number of workers.",
+		nil,
+		func() []metrics.Sample {
+			return []metrics.Sample{{Value: float64(prober.CurrentWorkersCount())}}
+		},
+	)
+	if prober.dispatcher != nil {
+		prober.Metrics.NewGaugeFunc(
+			"nats_prober_handler_backlog",
+			"Number of outcomes queued for asynchronous handlers.",
+			nil,
+			func() []metrics.Sample {
+				return []metrics.Sample{{Value: float64(prober.dispatcher.backlog())}}
+			},
+		)
+	}
+	if len(prober.ClusterSubject) > 0 {
+		prober.Metrics.NewGaugeFunc(
+			"nats_prober_cluster_members",
+			"Number of known cluster members, including this instance.",
+			nil,
+			func() []metrics.Sample {
+				return []metrics.Sample{{Value: float64(len(prober.ClusterMembers()))}}
+			},
+		)
+	}
+	prober.Metrics.NewGaugeFunc(
+		"nats_prober_worker_pending_requests",
+		"Number of requests waiting for response by worker.",
+		[]string{"worker"},
+		func() []metrics.Sample {
+			workers := prober.workersSnapshot()
+			samples := make([]metrics.Sample, len(workers))
+			for i, w := range workers {
+				samples[i] = metrics.Sample{
+					LabelValues: []string{strconv.FormatUint(w.id, 10)},
+					Value:       float64(atomic.LoadInt64(&w.pendingCount)),
+				}
+			}
+			return samples
+		},
+	)
+	prober.Metrics.NewGaugeFunc(
+		"nats_prober_worker_pending_bytes",
+		"Estimated bytes of pending requests and orphan responses by worker.",
+		[]string{"worker"},
+		func() []metrics.Sample {
+			workers := prober.workersSnapshot()
+			samples := make([]metrics.Sample, len(workers))
+			for i, w := range workers {
+				samples[i] = metrics.Sample{
+					LabelValues: []string{strconv.FormatUint(w.id, 10)},
+					Value:       float64(atomic.LoadInt64(&w.pendingBytes)),
+				}
+			}
+			return samples
+		},
+	)
+	prober.Metrics.NewGaugeFunc(
+		"nats_prober_worker_backlog",
+		"Number of messages queued in worker channels.",
+		[]string{"worker", "queue"},
+		func() []metrics.Sample {
+			workers := prober.workersSnapshot()
+			samples := make([]metrics.Sample, 0, len(workers)*2)
+			for _, w := range workers {
+				id := strconv.FormatUint(w.id, 10)
+				samples = append(samples,
+					metrics.Sample{LabelValues: []string{id, "requests"}, Value: float64(len(w.requests))},
+					metrics.Sample{LabelValues: []string{id, "responses"}, Value: float64(len(w.responses))},
+				)
+			}
+			return samples
+		},
+	)
+}
+
+func (m *proberMetrics) observe(outcome Outcome, request *NatsMessage, response *NatsMessage) {
+	if m == nil {
+		return
+	}
+	subject := ""
+	synthetic := false
+	if request != nil {
+		subject = m.subjects.label(request.Msg.Subject)
+		synthetic = request.Synthetic
+	}
+	if response != nil {
+		synthetic = synthetic || response.Synthetic
+	}
+	m.outcomes.WithLabelValues(string(outcome), subject, strconv.FormatBool(synthetic)).Inc()
+	if request != nil && response != nil {
+		m.latency.WithLabelValues(subject, strconv.FormatBool(synthetic)).Observe(int64(response.ReceivedAt.Sub(request.ReceivedAt)))
+	}
+}
+
+func (m *proberMetrics) observeDrop(reason DropReason) {
+	if m == nil {
+		return
+	}
+	m.drops.WithLabelValues(string(reason)).Inc()
+}
+
+func (m *proberMetrics) observeReject(request *NatsMessage) {
+	if m == nil {
+		return
+	}
+	m.rejects.WithLabelValues(m.subjects.label(request.Msg.Subject)).Inc()
+}
+
+func (m *proberMetrics) observeForward(kind string) {
+	if m == nil {
+		return
+	}
+	m.forwards.WithLabelValues(kind).Inc()
+}
+
+func (m *proberMetrics) observeStatus(request *NatsMessage, status int) {
+	if m == nil {
+		return
+	}
+	m.statuses.WithLabelValues(m.subjects.label(request.Msg.Subject), strconv.Itoa(status)).Inc()
+}
+
+func (m *proberMetrics) observePublish(message *NatsMessage) {
+	if m == nil {
+		return
+	}
+	size := message.payloadSize()
+	subject := m.subjects.label(message.Msg.Subject)
+	m.publishBytes.WithLabelValues(subject).Add(uint64(size))
+	m.publishSizes.WithLabelValues(subject).Observe(int64(size))
+}
+
+func (m *proberMetrics) observeHandlerOverflow(outcome Outcome) {
+	if m == nil {
+		return
+	}
+	m.handlerOverflows.WithLabelValues(string(outcome)).Inc()
+}
+
+func (m *proberMetrics) observeSubscriberDrop(outcome Outcome) {
+	if m == nil {
+		return
+	}
+	m.subscriberDrops.WithLabelValues(string(outcome)).Inc()
+}
+
+// subjectLabels bounds cardinality of subject labels: the first max distinct subjects
+// are used as is, and the rest are labeled as otherSubjectLabel.
+type subjectLabels struct {
+	max int
+
+	mu       sync.RWMutex
+	subjects map[string]struct{}
+}
+
+func (l *subjectLabels) label(subject string) string {
+	l.mu.RLock()
+	_, ok := l.subjects[subject]
+	l.mu.RUnlock()
+	if ok {
+		return subject
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.subjects[subject]; ok {
+		return subject
+	}
+	if len(l.subjects) >= l.max {
+		return otherSubjectLabel
+	}
+	if l.subjects == nil {
+		l.subjects = make(map[string]struct{})
+	}
+	l.subjects[subject] = struct{}{}
+	return subject
+}
@@ -0,0 +1,37 @@
+package natsprober
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aurora-is-near/nats-prober/metrics"
+)
+
+func TestMetricsMaxSubjects(t *testing.T) {
+	prober := &NatsProber{
+		Metrics:            metrics.NewRegistry(),
+		MetricsMaxSubjects: 2,
+	}
+	prober.startMetrics()
+
+	for _, subject := range []string{"a", "b", "c", "a", "d"} {
+		request := testSubjectRequest(subject, "key", time.Now())
+		prober.metrics.observe(OutcomeTimeouted, request, nil)
+	}
+
+	var buf bytes.Buffer
+	if _, err := prober.Metrics.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo: %s", err)
+	}
+	for _, line := range []string{
+		`nats_prober_outcomes_total{outcome="timeouted",subject="a",synthetic="false"} 2`,
+		`nats_prober_outcomes_total{outcome="timeouted",subject="b",synthetic="false"} 1`,
+		`nats_prober_outcomes_total{outcome="timeouted",subject="_other",synthetic="false"} 2`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("Missing line %q in:\n%s", line, buf.String())
+		}
+	}
+}
@@ -9,11 +9,45 @@ import (
 type NatsMessage struct {
 	Msg        *nats.Msg
 	ReceivedAt time.Time
+	// Key is the correlation key extracted by prober's Correlator
+	Key string
+	// Synthetic is set for requests published by the prober itself and their responses
+	Synthetic bool
+
+	// Size of the original payload, Msg.Data may be reduced by CapturePolicy
+	Size int
+	// PayloadHash is hex SHA-256 of the original payload, set by CaptureHash policy
+	PayloadHash string
+	// Whether CapturePolicy was already applied
+	captured bool
 }
 
-func newNatsMessage(msg *nats.Msg) *NatsMessage {
+func newNatsMessage(msg *nats.Msg, key string) *NatsMessage {
 	return &NatsMessage{
 		Msg:        msg,
 		ReceivedAt: time.Now(),
+		Key:        key,
+		Size:       len(msg.Data),
+	}
+}
+
+// memorySize estimates bytes held by message: subjects, headers, payload and key.
+func (message *NatsMessage) memorySize() int64 {
+	size := len(message.Msg.Subject) + len(message.Msg.Reply) + len(message.Msg.Data) +
+		len(message.Key) + len(message.PayloadHash)
+	for name, values := range message.Msg.Header {
+		size += len(name)
+		for _, value := range values {
+			size += len(value)
+		}
+	}
+	return int64(size)
+}
+
+// payloadSize returns size of the original payload.
+func (message *NatsMessage) payloadSize() int {
+	if message.Size > 0 {
+		return message.Size
 	}
+	return len(message.Msg.Data)
 }
@@ -1,29 +1,190 @@
 package natsprober
 
 import (
-	"hash/maphash"
+	"context"
 	"log"
 	"sync"
+	"time"
 
+	"github.com/aurora-is-near/nats-prober/metrics"
 	"github.com/nats-io/nats.go"
 )
 
+const drainCheckInterval = time.Millisecond * 10
+
 type NatsProber struct {
+	// Subjects subscribed to on Start, use Add*Subject and Remove*Subject methods to change them afterwards
 	RequestSubjects          []string
 	ResponseSubjects         []string
 	RequestTimeoutSeconds    uint
 	WorkersCount             uint
 	WorkerMaxPendingRequests uint
+	// WorkerMaxPendingRequests limits requests pending in each worker and orphan responses held
+	// by it (unlimited if 0), DropPolicy is applied when it's reached,
+	// DropSampleRate is only used with DropSample policy
+	DropPolicy     DropPolicy
+	DropSampleRate float64
+	// WorkerMaxPendingBytes and MaxPendingBytes limit bytes of requests pending in each worker
+	// and in all workers (unlimited if 0), DropPolicy is applied when either is exceeded.
+	// Sizes are estimated from subjects, headers and payloads kept after CapturePolicies.
+	WorkerMaxPendingBytes uint64
+	MaxPendingBytes       uint64
+	// RequestTimeout overrides RequestTimeoutSeconds if set
+	RequestTimeout time.Duration
+	// Policies override timeout and capacity per request subject, the first matching one is used
+	Policies []SubjectPolicy
+
+	// AutoResponseSubjects enables subscribing to response subjects derived from reply subjects
+	// of observed requests (e.g. "_INBOX.<nuid>.*" for muxed inboxes), in addition to ResponseSubjects.
+	// Such subscriptions are removed after being unused for ResponseSubscriptionExpiry (1 minute by default).
+	// Single-token inboxes ("<AutoResponseInboxPrefix>.<nuid>", prefix is "_INBOX" by default) get
+	// a new reply subject per request, so they are all covered by "<AutoResponseInboxPrefix>.*"
+	// subscribed on Start. Inboxes covered by ResponseSubjects, including ones added at runtime,
+	// aren't subscribed to on their own, so that responses aren't received twice. Note that
+	// the first response to a muxed inbox may still arrive before its subscription is established,
+	// and be missed.
+	AutoResponseSubjects       bool
+	AutoResponseInboxPrefix    string
+	ResponseSubscriptionExpiry time.Duration
+
+	// GatherResponses keeps requests pending after the first response, so that
+	// scatter-gather and streaming replies are all matched. A request is completed
+	// after GatherWindow (request timeout if not set, or subject policy's timeout) since it was received,
+	// or once GatherMaxResponses responses arrived (unlimited if 0).
+	// Requests without any response are reported as timeouted.
+	GatherResponses    bool
+	GatherWindow       time.Duration
+	GatherMaxResponses uint
+
+	// Correlator matches responses to requests, ReplySubjectCorrelator is used if not set.
+	Correlator Correlator
+
+	// WorkerQueueSize is the capacity of each worker's request and response queues (100 by default).
+	// With NonBlockingEnqueue, messages that don't fit are reported to dropped handler
+	// instead of blocking NATS subscription.
+	WorkerQueueSize    uint
+	NonBlockingEnqueue bool
+
+	// ControlSubject, if set, accepts ControlCommand requests to change subjects at runtime.
+	ControlSubject string
+	// StatsSubject, if set (e.g. DefaultStatsSubject), replies to requests with Stats as JSON.
+	StatsSubject string
+
+	// AutoscaleMaxWorkers enables adding workers, up to the given count, when average backlog
+	// of worker queues stays at or above AutoscaleBacklogThreshold for AutoscaleSustainedChecks
+	// consecutive checks (5 by default) made every AutoscaleInterval (1 second by default).
+	AutoscaleMaxWorkers       uint
+	AutoscaleBacklogThreshold uint
+	AutoscaleInterval         time.Duration
+	AutoscaleSustainedChecks  uint
+
+	// ClusterSubject enables clustered mode: instances sharing ClusterSubject and ClusterQueueGroup
+	// ("nats-prober" by default) receive messages in a queue group and forward each one to the instance
+	// owning its correlation key over "<ClusterSubject>.forward.<instance>". Instances announce themselves
+	// on "<ClusterSubject>.heartbeat" every ClusterHeartbeatInterval (1 second by default) and are
+	// considered gone after ClusterMemberTimeout (3 intervals by default). Pending requests are migrated
+	// to their new owners when instances join or leave, along with orphan responses. ClusterInstanceID
+	// is random if not set, and must be a single subject token (without '.', '*' or '>').
+	// Latencies of forwarded messages rely on clocks of instances being in sync.
+	ClusterSubject           string
+	ClusterQueueGroup        string
+	ClusterInstanceID        string
+	ClusterHeartbeatInterval time.Duration
+	ClusterMemberTimeout     time.Duration
+
+	// OrphanResponseGrace holds responses without pending request for the given duration before
+	// reporting them as unknown, in case their request arrives later. It's 100ms by default in
+	// clustered mode, where a forwarded response may overtake its forwarded request.
+	OrphanResponseGrace time.Duration
+
+	// Validators check responses matched to requests, all ones matching request subject are applied
+	// in order. Responses failing validation are reported to invalid response handler instead of
+	// successful one. In GatherResponses mode invalid responses are not counted as gathered.
+	Validators []SubjectValidator
+
+	// CapturePolicies limit payload and headers kept in memory and passed to handlers,
+	// the first one matching message subject is used. Messages are kept intact if none matches.
+	CapturePolicies []CapturePolicy
 
-	successfulResponseHandler func(request *NatsMessage, response *NatsMessage)
-	timeoutedRequestHandler   func(request *NatsMessage)
-	unknownResponseHandler    func(response *NatsMessage)
-	droppedRequestHandler     func(request *NatsMessage)
+	// SyntheticProbes are requests published by the prober itself, so that services are probed
+	// without organic traffic. Their outcomes are reported as usual, marked as Synthetic.
+	// Their reply subjects are under "_INBOX.prober_synthetic", requests and responses
+	// there are ignored by passive subscriptions, including ones of other instances.
+	SyntheticProbes []SyntheticProbe
 
-	mapHashSeed   maphash.Seed
-	workers       []*worker
-	subscriptions []*nats.Subscription
-	handlersWg    sync.WaitGroup
+	// MaxDuplicateRequests is the number of requests reusing the key of a pending request
+	// (e.g. a client reusing its reply subject) queued behind it, so that the following responses
+	// are matched to them in order. Beyond that the earliest request of the key is reported
+	// to superseded request handler and replaced by the new one. Queued requests count against
+	// pending requests limits and byte budgets like pending ones.
+	MaxDuplicateRequests uint
+
+	// HandlerWorkers enables asynchronous dispatch: handlers, including event handler, run on
+	// HandlerWorkers goroutines instead of worker ones, so slow handlers don't delay matching
+	// and timeouts. Outcomes of the same correlation key are handled in order they were reported.
+	// Each goroutine queues up to HandlerQueueSize outcomes (1000 by default), outcomes that don't fit
+	// are not passed to handlers, only counted in Stats and metrics.
+	HandlerWorkers   uint
+	HandlerQueueSize uint
+
+	// Pipeline stages are applied in order to every outcome before it's passed to handlers,
+	// event handler and subscribers. Outcomes stopped by a stage are still counted in Stats and metrics.
+	// Stages run on handler goroutines concurrently, so they must be safe for concurrent use.
+	Pipeline []Stage
+
+	// SubscriberBufferSize is the capacity of channels returned by Subscribe (100 by default).
+	SubscriberBufferSize uint
+
+	// DrainOnStop makes Stop keep listening for responses after unsubscribing from requests,
+	// until requests received before Stop are resolved or its context is done.
+	// Requests still pending then are reported to abandoned request handler.
+	DrainOnStop bool
+
+	// Metrics, if set, receives outcome counters, latency histograms and worker gauges.
+	Metrics *metrics.Registry
+	// MetricsMaxSubjects limits number of distinct subject labels in metrics (100 by default),
+	// further subjects are labeled as "_other".
+	MetricsMaxSubjects uint
+
+	successfulResponseHandler   func(request *NatsMessage, response *NatsMessage)
+	timeoutedRequestHandler     func(request *NatsMessage)
+	unknownResponseHandler      func(response *NatsMessage)
+	droppedRequestHandler       func(request *NatsMessage)
+	droppedRequestReasonHandler func(request *NatsMessage, reason DropReason)
+	droppedResponseHandler      func(response *NatsMessage, reason DropReason)
+	invalidResponseHandler      func(request *NatsMessage, response *NatsMessage, reason error)
+	noRespondersHandler         func(request *NatsMessage, response *NatsMessage, status int)
+	gatheredResponseHandler     func(request *NatsMessage, response *NatsMessage, ordinal uint)
+	gatherCompletedHandler      func(request *NatsMessage, result *GatherResult)
+	abandonedRequestHandler     func(request *NatsMessage)
+	publishHandler              func(message *NatsMessage)
+	supersededRequestHandler    func(request *NatsMessage, supersededBy *NatsMessage)
+	eventHandler                func(event *ProbeEvent)
+
+	natsConn    *nats.Conn
+	inboxes     *inboxTracker
+	cluster     *cluster
+	synthetic   *synthetic
+	metrics     *proberMetrics
+	dispatcher  *dispatcher
+	subscribers eventSubscribers
+	autoscaler  *autoscaler
+	// Serializes Stats snapshots, as each of them pauses all workers at once
+	statsMu      sync.Mutex
+	workersMu    sync.RWMutex
+	workers      []*worker
+	workerIDs    []uint64
+	lastWorkerID uint64
+	// Bytes pending in all workers, updated atomically
+	pendingBytes int64
+	requestSubs  subscriptionSet
+	responseSubs subscriptionSet
+	controlSub   *nats.Subscription
+	statsSub     *nats.Subscription
+	counters     proberCounters
+	handlersWg   sync.WaitGroup
+	stopOnce     sync.Once
+	stopErr      error
 }
 
 func (prober *NatsProber) SetSuccessfulResponseHandler(handler func(request *NatsMessage, response *NatsMessage)) {
@@ -42,42 +203,198 @@ func (prober *NatsProber) SetDroppedRequestHandler(handler func(request *NatsMes
 	prober.droppedRequestHandler = handler
 }
 
+// SetDroppedRequestReasonHandler sets handler for dropped requests receiving the reason,
+// called after the one set by SetDroppedRequestHandler. In NonBlockingEnqueue mode
+// it may be called from NATS subscription goroutines.
+func (prober *NatsProber) SetDroppedRequestReasonHandler(handler func(request *NatsMessage, reason DropReason)) {
+	prober.droppedRequestReasonHandler = handler
+}
+
+// SetDroppedResponseHandler sets handler for responses dropped in NonBlockingEnqueue mode
+// with DropReasonResponseQueueOverflow, called from NATS subscription goroutines.
+func (prober *NatsProber) SetDroppedResponseHandler(handler func(response *NatsMessage, reason DropReason)) {
+	prober.droppedResponseHandler = handler
+}
+
+// SetInvalidResponseHandler sets handler for responses failing Validators.
+func (prober *NatsProber) SetInvalidResponseHandler(handler func(request *NatsMessage, response *NatsMessage, reason error)) {
+	prober.invalidResponseHandler = handler
+}
+
+// SetNoRespondersHandler sets handler for requests answered by NATS status message
+// instead of a response: 503 (no responders), 408 (timeout), 409 (conflict) and others.
+// Such requests are resolved, in GatherResponses mode they are reported to gather completed
+// handler instead if some responses were gathered before.
+func (prober *NatsProber) SetNoRespondersHandler(handler func(request *NatsMessage, response *NatsMessage, status int)) {
+	prober.noRespondersHandler = handler
+}
+
+// SetGatheredResponseHandler sets handler for each response in GatherResponses mode,
+// ordinal is 1 for the first response to a request.
+func (prober *NatsProber) SetGatheredResponseHandler(handler func(request *NatsMessage, response *NatsMessage, ordinal uint)) {
+	prober.gatheredResponseHandler = handler
+}
+
+// SetGatherCompletedHandler sets handler for requests that got at least one response in GatherResponses mode.
+func (prober *NatsProber) SetGatherCompletedHandler(handler func(request *NatsMessage, result *GatherResult)) {
+	prober.gatherCompletedHandler = handler
+}
+
+// SetAbandonedRequestHandler sets handler for requests still pending when Stop stops workers,
+// so that every request observed gets exactly one final outcome.
+func (prober *NatsProber) SetAbandonedRequestHandler(handler func(request *NatsMessage)) {
+	prober.abandonedRequestHandler = handler
+}
+
+// SetPublishHandler sets handler for one-way publishes: messages on request subjects without
+// reply subject. They are never correlated with responses nor kept pending, and are reported
+// right away from NATS subscription goroutines.
+func (prober *NatsProber) SetPublishHandler(handler func(message *NatsMessage)) {
+	prober.publishHandler = handler
+}
+
+// SetSupersededRequestHandler sets handler for pending requests replaced by a later request
+// with the same key, see MaxDuplicateRequests.
+func (prober *NatsProber) SetSupersededRequestHandler(handler func(request *NatsMessage, supersededBy *NatsMessage)) {
+	prober.supersededRequestHandler = handler
+}
+
+// SetEventHandler sets handler that receives every outcome as ProbeEvent,
+// in addition to the outcome-specific handlers. See Subscribe for multiple consumers.
+func (prober *NatsProber) SetEventHandler(handler func(event *ProbeEvent)) {
+	prober.eventHandler = handler
+}
+
 func (prober *NatsProber) Start(nc *nats.Conn) error {
-	prober.mapHashSeed = maphash.MakeSeed()
+	prober.natsConn = nc
+	if prober.Correlator == nil {
+		prober.Correlator = ReplySubjectCorrelator{}
+	}
+
+	if prober.HandlerWorkers > 0 {
+		prober.dispatcher = startDispatcher(prober)
+	}
+	prober.startMetrics()
 
 	log.Printf("NatsProber: starting workers...")
-	for i := 0; i < int(prober.WorkersCount); i++ {
-		prober.workers = append(prober.workers, startWorker(prober))
+	prober.startWorkers()
+
+	if prober.AutoscaleMaxWorkers > 0 {
+		prober.autoscaler = startAutoscaler(prober)
 	}
 
-	log.Printf("NatsProber: subscribing to requests...")
-	for _, subject := range prober.RequestSubjects {
-		sub, err := nc.Subscribe(subject, prober.handleRequest)
-		if err != nil {
-			prober.Stop()
+	if len(prober.SyntheticProbes) > 0 {
+		log.Printf("NatsProber: starting synthetic probes...")
+		var err error
+		if prober.synthetic, err = startSynthetic(prober); err != nil {
+			prober.Stop(context.Background())
+			return err
+		}
+	}
+
+	if len(prober.ClusterSubject) > 0 {
+		log.Printf("NatsProber: joining cluster...")
+		var err error
+		if prober.cluster, err = startCluster(prober); err != nil {
+			prober.Stop(context.Background())
 			return err
 		}
-		prober.subscriptions = append(prober.subscriptions, sub)
 	}
 
 	log.Printf("NatsProber: subscribing to responses...")
 	for _, subject := range prober.ResponseSubjects {
-		sub, err := nc.Subscribe(subject, prober.handleResponse)
-		if err != nil {
-			prober.Stop()
+		if err := prober.AddResponseSubject(subject); err != nil {
+			prober.Stop(context.Background())
+			return err
+		}
+	}
+
+	// Started after response subscriptions, so that it only subscribes to inboxes they don't cover
+	if prober.AutoResponseSubjects {
+		var err error
+		if prober.inboxes, err = startInboxTracker(prober); err != nil {
+			prober.Stop(context.Background())
+			return err
+		}
+	}
+
+	log.Printf("NatsProber: subscribing to requests...")
+	for _, subject := range prober.RequestSubjects {
+		if err := prober.AddRequestSubject(subject); err != nil {
+			prober.Stop(context.Background())
+			return err
+		}
+	}
+
+	if len(prober.ControlSubject) > 0 {
+		log.Printf("NatsProber: subscribing to control subject...")
+		var err error
+		if prober.controlSub, err = nc.Subscribe(prober.ControlSubject, prober.handleControl); err != nil {
+			prober.Stop(context.Background())
+			return err
+		}
+	}
+
+	if len(prober.StatsSubject) > 0 {
+		log.Printf("NatsProber: subscribing to stats subject...")
+		var err error
+		if prober.statsSub, err = nc.Subscribe(prober.StatsSubject, prober.handleStats); err != nil {
+			prober.Stop(context.Background())
 			return err
 		}
-		prober.subscriptions = append(prober.subscriptions, sub)
 	}
 
 	return nil
 }
 
-func (prober *NatsProber) Stop() error {
-	log.Printf("NatsProber: unsubscribing...")
+// Stop unsubscribes, waits for pending requests to resolve with DrainOnStop (until ctx is done),
+// leaves the cluster and stops workers, reporting requests left pending as abandoned and
+// held orphan responses as unknown. Subsequent calls return the result of the first one.
+func (prober *NatsProber) Stop(ctx context.Context) error {
+	prober.stopOnce.Do(func() {
+		prober.stopErr = prober.stop(ctx)
+	})
+	return prober.stopErr
+}
+
+func (prober *NatsProber) stop(ctx context.Context) error {
+	if prober.synthetic != nil {
+		log.Printf("NatsProber: stopping synthetic probes...")
+		prober.synthetic.stop()
+	}
+
+	log.Printf("NatsProber: unsubscribing from requests...")
 	var unsubErr error
-	for _, sub := range prober.subscriptions {
-		if err := sub.Unsubscribe(); err != nil {
+	if prober.controlSub != nil {
+		if err := prober.controlSub.Unsubscribe(); err != nil {
+			unsubErr = err
+		}
+	}
+	if prober.statsSub != nil {
+		if err := prober.statsSub.Unsubscribe(); err != nil {
+			unsubErr = err
+		}
+	}
+	if err := prober.requestSubs.removeAll(); err != nil {
+		unsubErr = err
+	}
+
+	if prober.DrainOnStop {
+		log.Printf("NatsProber: draining pending requests...")
+		prober.drain(ctx)
+	}
+
+	log.Printf("NatsProber: unsubscribing from responses...")
+	if prober.synthetic != nil {
+		if err := prober.synthetic.unsubscribe(); err != nil {
+			unsubErr = err
+		}
+	}
+	if err := prober.responseSubs.removeAll(); err != nil {
+		unsubErr = err
+	}
+	if prober.inboxes != nil {
+		if err := prober.inboxes.stop(); err != nil {
 			unsubErr = err
 		}
 	}
@@ -87,32 +404,319 @@ func (prober *NatsProber) Stop() error {
 		prober.handlersWg.Wait()
 	}
 
+	if prober.cluster != nil {
+		log.Printf("NatsProber: leaving cluster...")
+		if err := prober.cluster.stop(); err != nil {
+			unsubErr = err
+		}
+	}
+
+	if prober.autoscaler != nil {
+		prober.autoscaler.stop()
+	}
+
 	log.Printf("NatsProber: stopping workers...")
-	for _, w := range prober.workers {
+	// Workers are detached first, so that handlers called while abandoning may use the prober
+	prober.workersMu.Lock()
+	workers := prober.workers
+	prober.workers = nil
+	prober.workerIDs = nil
+	prober.workersMu.Unlock()
+	for _, w := range workers {
+		w.execute(w.abandon)
 		w.stop()
 	}
 
+	if prober.dispatcher != nil {
+		log.Printf("NatsProber: waiting for queued handlers...")
+		prober.dispatcher.stop()
+	}
+	prober.subscribers.close()
+
 	return unsubErr
 }
 
+// drain waits until requests received before it started are resolved, or ctx is done.
+func (prober *NatsProber) drain(ctx context.Context) {
+	since := time.Now()
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+	for !prober.drained(since) {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			log.Printf("NatsProber: stopped draining: %v", ctx.Err())
+			return
+		}
+	}
+}
+
+func (prober *NatsProber) drained(since time.Time) bool {
+	for _, w := range prober.workersSnapshot() {
+		drained := true
+		w.execute(func() {
+			w.drainQueues()
+			w.pendingRequests.ForEach(func(_ string, pending *pendingRequest) bool {
+				drained = !pending.request.ReceivedAt.Before(since)
+				return drained
+			})
+		})
+		if !drained {
+			return false
+		}
+	}
+	return true
+}
+
 func (prober *NatsProber) handleRequest(request *nats.Msg) {
 	prober.handlersWg.Add(1)
 	defer prober.handlersWg.Done()
-	message := newNatsMessage(request)
-	prober.getWorker(request.Reply).addRequest(message)
+	if isSyntheticReply(request.Reply) {
+		return
+	}
+	if len(request.Reply) == 0 {
+		prober.reportPublish(newNatsMessage(request, ""))
+		return
+	}
+	key, ok := prober.Correlator.RequestKey(request)
+	if !ok {
+		return
+	}
+	message := newNatsMessage(request, key)
+	if prober.cluster != nil && prober.cluster.forward(clusterKindRequest, message) {
+		return
+	}
+	prober.enqueueRequest(message)
+}
+
+// enqueueRequest passes request owned by this instance to its worker.
+func (prober *NatsProber) enqueueRequest(request *NatsMessage) {
+	request = prober.capture(request)
+	if prober.inboxes != nil && !request.Synthetic {
+		prober.inboxes.acquire(request.Msg.Reply)
+	}
+	prober.workersMu.RLock()
+	defer prober.workersMu.RUnlock()
+	if len(prober.workers) == 0 {
+		// Stopped, but a subscription that failed to unsubscribe still delivers messages
+		prober.requestResolved(request)
+		return
+	}
+	prober.getWorker(request.Key).addRequest(request)
+}
+
+// dropRequest drops request enqueued by enqueueRequest, unless it's already resolved.
+func (prober *NatsProber) dropRequest(request *NatsMessage, reason DropReason) {
+	prober.workersMu.RLock()
+	defer prober.workersMu.RUnlock()
+	if len(prober.workers) == 0 {
+		return
+	}
+	prober.getWorker(request.Key).drop(request.Key, reason)
 }
 
 func (prober *NatsProber) handleResponse(response *nats.Msg) {
 	prober.handlersWg.Add(1)
 	defer prober.handlersWg.Done()
-	message := newNatsMessage(response)
-	prober.getWorker(response.Subject).addResponse(message)
+	if isSyntheticReply(response.Subject) {
+		return
+	}
+	// Responses without key are still passed to some worker to be reported as unknown
+	key, _ := prober.Correlator.ResponseKey(response)
+	message := newNatsMessage(response, key)
+	if prober.cluster != nil && len(key) > 0 && prober.cluster.forward(clusterKindResponse, message) {
+		return
+	}
+	prober.enqueueResponse(message)
+}
+
+func (prober *NatsProber) enqueueResponse(response *NatsMessage) {
+	prober.workersMu.RLock()
+	defer prober.workersMu.RUnlock()
+	if len(prober.workers) == 0 {
+		return
+	}
+	prober.getWorker(response.Key).addResponse(response)
+}
+
+// subscribe subscribes handler to subject, in the cluster's queue group in clustered mode.
+func (prober *NatsProber) subscribe(subject string, handler nats.MsgHandler) (*nats.Subscription, error) {
+	if prober.cluster != nil {
+		return prober.natsConn.QueueSubscribe(subject, prober.cluster.queueGroup, handler)
+	}
+	return prober.natsConn.Subscribe(subject, handler)
+}
+
+// requestResolved must be called once for each request leaving pending state.
+func (prober *NatsProber) requestResolved(request *NatsMessage) {
+	if prober.inboxes != nil && !request.Synthetic {
+		prober.inboxes.release(request.Msg.Reply)
+	}
+}
+
+func (prober *NatsProber) reportSuccessful(request *NatsMessage, response *NatsMessage) {
+	response = prober.captureResponse(request, response)
+	prober.requestResolved(request)
+	prober.reportEvent(OutcomeSuccessful, request, response, func() {
+		if prober.successfulResponseHandler != nil {
+			prober.successfulResponseHandler(request, response)
+		}
+	})
 }
 
-func (prober *NatsProber) getWorker(replySubject string) *worker {
-	var hash maphash.Hash
-	hash.SetSeed(prober.mapHashSeed)
-	hash.WriteString(replySubject)
-	index := int(hash.Sum64() % uint64(prober.WorkersCount))
-	return prober.workers[index]
+// reportInvalid reports response failing validation, resolved tells whether request is no more pending.
+func (prober *NatsProber) reportInvalid(request *NatsMessage, response *NatsMessage, reason error, resolved bool) {
+	response = prober.captureResponse(request, response)
+	if resolved {
+		prober.requestResolved(request)
+	}
+	prober.reportEvent(OutcomeInvalid, request, response, func() {
+		if prober.invalidResponseHandler != nil {
+			prober.invalidResponseHandler(request, response, reason)
+		}
+	}, func(event *ProbeEvent) {
+		event.InvalidReason = reason.Error()
+	})
+}
+
+func (prober *NatsProber) reportNoResponders(request *NatsMessage, response *NatsMessage, status int) {
+	response = prober.captureResponse(request, response)
+	prober.requestResolved(request)
+	prober.metrics.observeStatus(request, status)
+	prober.reportEvent(OutcomeNoResponders, request, response, func() {
+		if prober.noRespondersHandler != nil {
+			prober.noRespondersHandler(request, response, status)
+		}
+	}, func(event *ProbeEvent) {
+		event.Status = status
+	})
+}
+
+func (prober *NatsProber) reportTimeouted(request *NatsMessage) {
+	prober.requestResolved(request)
+	prober.reportEvent(OutcomeTimeouted, request, nil, func() {
+		if prober.timeoutedRequestHandler != nil {
+			prober.timeoutedRequestHandler(request)
+		}
+	})
+}
+
+func (prober *NatsProber) reportPublish(message *NatsMessage) {
+	message = prober.capture(message)
+	prober.metrics.observePublish(message)
+	prober.reportEvent(OutcomePublish, message, nil, func() {
+		if prober.publishHandler != nil {
+			prober.publishHandler(message)
+		}
+	})
+}
+
+func (prober *NatsProber) reportSuperseded(request *NatsMessage, supersededBy *NatsMessage) {
+	prober.requestResolved(request)
+	prober.reportEvent(OutcomeSuperseded, request, nil, func() {
+		if prober.supersededRequestHandler != nil {
+			prober.supersededRequestHandler(request, supersededBy)
+		}
+	})
+}
+
+func (prober *NatsProber) reportAbandoned(request *NatsMessage) {
+	prober.requestResolved(request)
+	prober.reportEvent(OutcomeAbandoned, request, nil, func() {
+		if prober.abandonedRequestHandler != nil {
+			prober.abandonedRequestHandler(request)
+		}
+	})
+}
+
+func (prober *NatsProber) reportUnknown(response *NatsMessage) {
+	response = prober.capture(response)
+	prober.reportEvent(OutcomeUnknown, nil, response, func() {
+		if prober.unknownResponseHandler != nil {
+			prober.unknownResponseHandler(response)
+		}
+	})
+}
+
+func (prober *NatsProber) reportDropped(request *NatsMessage, reason DropReason) {
+	prober.requestResolved(request)
+	prober.metrics.observeDrop(reason)
+	prober.reportEvent(OutcomeDropped, request, nil, func() {
+		if prober.droppedRequestHandler != nil {
+			prober.droppedRequestHandler(request)
+		}
+		if prober.droppedRequestReasonHandler != nil {
+			prober.droppedRequestReasonHandler(request, reason)
+		}
+	}, func(event *ProbeEvent) {
+		event.DropReason = reason
+	})
+}
+
+func (prober *NatsProber) reportDroppedResponse(response *NatsMessage, reason DropReason) {
+	response = prober.capture(response)
+	prober.metrics.observeDrop(reason)
+	prober.reportEvent(OutcomeDropped, nil, response, func() {
+		if prober.droppedResponseHandler != nil {
+			prober.droppedResponseHandler(response, reason)
+		}
+	}, func(event *ProbeEvent) {
+		event.DropReason = reason
+	})
+}
+
+// reportRejected only counts the request, as requested by RejectNew policy.
+func (prober *NatsProber) reportRejected(request *NatsMessage) {
+	prober.requestResolved(request)
+	prober.counters.countRejected()
+	prober.metrics.observeReject(request)
+}
+
+func (prober *NatsProber) reportGatheredResponse(request *NatsMessage, response *NatsMessage, ordinal uint) {
+	response = prober.captureResponse(request, response)
+	prober.reportEvent(OutcomeGatheredResponse, request, response, func() {
+		if prober.gatheredResponseHandler != nil {
+			prober.gatheredResponseHandler(request, response, ordinal)
+		}
+	}, func(event *ProbeEvent) {
+		event.Ordinal = ordinal
+	})
+}
+
+func (prober *NatsProber) reportGatherCompleted(request *NatsMessage, result *GatherResult) {
+	prober.requestResolved(request)
+	prober.reportEvent(OutcomeGatherCompleted, request, nil, func() {
+		if prober.gatherCompletedHandler != nil {
+			prober.gatherCompletedHandler(request, result)
+		}
+	}, func(event *ProbeEvent) {
+		event.Responses = result.Responses
+		event.Latency = result.FirstLatency
+		event.LastLatency = result.LastLatency
+	})
+}
+
+// reportEvent counts outcome, then runs it through Pipeline and, if passed, runs handle
+// followed by event handler and subscribers on dispatcher.
+func (prober *NatsProber) reportEvent(outcome Outcome, request *NatsMessage, response *NatsMessage, handle func(), fill ...func(event *ProbeEvent)) {
+	prober.counters.countOutcome(outcome)
+	prober.metrics.observe(outcome, request, response)
+	prober.dispatch(outcome, dispatchKey(request, response), func() {
+		if len(prober.Pipeline) == 0 && prober.eventHandler == nil && !prober.subscribers.active() {
+			handle()
+			return
+		}
+		event := NewProbeEvent(outcome, request, response)
+		for _, f := range fill {
+			f(event)
+		}
+		if !prober.runPipeline(event) {
+			return
+		}
+		handle()
+		if prober.eventHandler != nil {
+			prober.eventHandler(event)
+		}
+		prober.publishEvent(event)
+	})
 }
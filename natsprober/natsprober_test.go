@@ -0,0 +1,531 @@
+package natsprober_test
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aurora-is-near/nats-prober/natsprober"
+	"github.com/aurora-is-near/nats-prober/testutil"
+	"github.com/nats-io/nats.go"
+)
+
+func startProber(t *testing.T, nc *nats.Conn, prober *natsprober.NatsProber) *testutil.Recorder {
+	t.Helper()
+	recorder := testutil.NewRecorder()
+	recorder.Attach(prober)
+	if err := prober.Start(nc); err != nil {
+		t.Fatalf("Can't start prober: %v", err)
+	}
+	t.Cleanup(func() { prober.Stop(context.Background()) })
+	testutil.Flush(t, nc)
+	return recorder
+}
+
+func publishRequests(t *testing.T, nc *nats.Conn, subject string, count int) {
+	t.Helper()
+	for i := 0; i < count; i++ {
+		if err := nc.PublishRequest(subject, "_INBOX.test."+strconv.Itoa(i), []byte(strconv.Itoa(i))); err != nil {
+			t.Fatalf("Can't publish request: %v", err)
+		}
+	}
+	testutil.Flush(t, nc)
+}
+
+func TestProberOutcomes(t *testing.T) {
+	server := testutil.RunServer(t)
+	client := testutil.Connect(t, server)
+	testutil.StartFakeService(t, testutil.Connect(t, server), "svc.echo",
+		testutil.Behavior{},
+		testutil.Behavior{Latency: time.Millisecond * 30},
+		testutil.Behavior{Drop: true},
+		testutil.Behavior{Duplicates: 1},
+	)
+	recorder := startProber(t, testutil.Connect(t, server), &natsprober.NatsProber{
+		RequestSubjects:          []string{"svc.>"},
+		ResponseSubjects:         []string{"_INBOX.>"},
+		RequestTimeout:           time.Millisecond * 200,
+		WorkersCount:             2,
+		WorkerMaxPendingRequests: 100,
+		// Immediate replies may be delivered before requests, as they come through another subscription
+		OrphanResponseGrace: time.Millisecond * 50,
+	})
+
+	publishRequests(t, client, "svc.echo", 4)
+
+	recorder.WaitCount(t, natsprober.OutcomeTimeouted, 1)
+	recorder.AssertCounts(t, map[natsprober.Outcome]int{
+		natsprober.OutcomeSuccessful: 3,
+		natsprober.OutcomeTimeouted:  1,
+		natsprober.OutcomeUnknown:    1,
+	})
+	if timeouted := recorder.Events(natsprober.OutcomeTimeouted)[0]; timeouted.ReplySubject != "_INBOX.test.2" {
+		t.Errorf("Wrong timeouted request %s", timeouted.ReplySubject)
+	}
+	for _, event := range recorder.Events(natsprober.OutcomeSuccessful) {
+		// Prober receives request a bit later than service
+		if event.ReplySubject == "_INBOX.test.1" && event.Latency < time.Millisecond*20 {
+			t.Errorf("Wrong latency %v of delayed response", event.Latency)
+		}
+	}
+}
+
+func TestProberGather(t *testing.T) {
+	server := testutil.RunServer(t)
+	client := testutil.Connect(t, server)
+	testutil.StartFakeService(t, testutil.Connect(t, server), "svc.echo", testutil.Behavior{Latency: time.Millisecond * 10, Duplicates: 2})
+	recorder := startProber(t, testutil.Connect(t, server), &natsprober.NatsProber{
+		RequestSubjects:          []string{"svc.>"},
+		ResponseSubjects:         []string{"_INBOX.>"},
+		RequestTimeoutSeconds:    10,
+		WorkersCount:             1,
+		WorkerMaxPendingRequests: 100,
+		GatherResponses:          true,
+		GatherWindow:             time.Millisecond * 100,
+	})
+
+	publishRequests(t, client, "svc.echo", 2)
+
+	recorder.WaitCount(t, natsprober.OutcomeGatherCompleted, 2)
+	recorder.AssertCounts(t, map[natsprober.Outcome]int{
+		natsprober.OutcomeGatheredResponse: 6,
+		natsprober.OutcomeGatherCompleted:  2,
+	})
+	for _, event := range recorder.Events(natsprober.OutcomeGatherCompleted) {
+		if event.Responses != 3 {
+			t.Errorf("Wrong number of gathered responses %d", event.Responses)
+		}
+	}
+}
+
+func TestProberDropNewest(t *testing.T) {
+	server := testutil.RunServer(t)
+	client := testutil.Connect(t, server)
+	testutil.StartFakeService(t, testutil.Connect(t, server), "svc.echo", testutil.Behavior{Drop: true})
+	recorder := startProber(t, testutil.Connect(t, server), &natsprober.NatsProber{
+		RequestSubjects:          []string{"svc.>"},
+		ResponseSubjects:         []string{"_INBOX.>"},
+		RequestTimeout:           time.Millisecond * 100,
+		WorkersCount:             1,
+		WorkerMaxPendingRequests: 2,
+		DropPolicy:               natsprober.DropNewest,
+	})
+
+	publishRequests(t, client, "svc.echo", 3)
+
+	recorder.WaitCount(t, natsprober.OutcomeTimeouted, 2)
+	recorder.AssertCounts(t, map[natsprober.Outcome]int{
+		natsprober.OutcomeTimeouted: 2,
+		natsprober.OutcomeDropped:   1,
+	})
+	dropped := recorder.Events(natsprober.OutcomeDropped)[0]
+	if dropped.ReplySubject != "_INBOX.test.2" || dropped.DropReason != natsprober.DropReasonCapacity {
+		t.Errorf("Wrong dropped request %s (%s)", dropped.ReplySubject, dropped.DropReason)
+	}
+}
+
+func TestProberAutoResponseSubjects(t *testing.T) {
+	server := testutil.RunServer(t)
+	client := testutil.Connect(t, server)
+	testutil.StartFakeService(t, testutil.Connect(t, server), "svc.echo", testutil.Behavior{Latency: time.Millisecond * 20})
+	recorder := startProber(t, testutil.Connect(t, server), &natsprober.NatsProber{
+		RequestSubjects:          []string{"svc.>"},
+		AutoResponseSubjects:     true,
+		RequestTimeoutSeconds:    10,
+		WorkersCount:             2,
+		WorkerMaxPendingRequests: 100,
+	})
+
+	for i := 0; i < 3; i++ {
+		if _, err := client.Request("svc.echo", nil, time.Second); err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+	}
+
+	recorder.WaitCount(t, natsprober.OutcomeSuccessful, 3)
+	recorder.AssertCounts(t, map[natsprober.Outcome]int{
+		natsprober.OutcomeSuccessful: 3,
+	})
+}
+
+func TestProberAutoResponseSingleTokenInboxes(t *testing.T) {
+	server := testutil.RunServer(t)
+	client := testutil.Connect(t, server)
+	testutil.StartFakeService(t, testutil.Connect(t, server), "svc.echo")
+	recorder := startProber(t, testutil.Connect(t, server), &natsprober.NatsProber{
+		RequestSubjects:          []string{"svc.>"},
+		AutoResponseSubjects:     true,
+		RequestTimeoutSeconds:    10,
+		WorkersCount:             2,
+		WorkerMaxPendingRequests: 100,
+		// Immediate replies may be delivered before requests, as they come through another subscription
+		OrphanResponseGrace: time.Millisecond * 50,
+	})
+
+	// Every request has its own inbox, the service replies right away
+	for i := 0; i < 20; i++ {
+		if err := client.PublishRequest("svc.echo", nats.NewInbox(), nil); err != nil {
+			t.Fatalf("Can't publish request: %v", err)
+		}
+	}
+	testutil.Flush(t, client)
+
+	recorder.WaitCount(t, natsprober.OutcomeSuccessful, 20)
+	recorder.AssertCounts(t, map[natsprober.Outcome]int{
+		natsprober.OutcomeSuccessful: 20,
+	})
+}
+
+func TestProberAutoResponseOverlappingSubjects(t *testing.T) {
+	server := testutil.RunServer(t)
+	client := testutil.Connect(t, server)
+	testutil.StartFakeService(t, testutil.Connect(t, server), "svc.echo",
+		testutil.Behavior{Latency: time.Millisecond * 20},
+	)
+	prober := &natsprober.NatsProber{
+		RequestSubjects:          []string{"svc.>"},
+		ResponseSubjects:         []string{"_INBOX.>"},
+		AutoResponseSubjects:     true,
+		RequestTimeoutSeconds:    10,
+		WorkersCount:             2,
+		WorkerMaxPendingRequests: 100,
+	}
+	recorder := startProber(t, testutil.Connect(t, server), prober)
+
+	publish := func(reply func(i int) string) {
+		t.Helper()
+		for i := 0; i < 5; i++ {
+			if err := client.PublishRequest("svc.echo", reply(i), nil); err != nil {
+				t.Fatalf("Can't publish request: %v", err)
+			}
+		}
+		testutil.Flush(t, client)
+	}
+	singleToken := func(int) string { return nats.NewInbox() }
+	muxed := func(i int) string { return "_INBOX.mux." + strconv.Itoa(i) }
+
+	// Configured response subject covers all inboxes, none are subscribed to on their own
+	publish(singleToken)
+	recorder.WaitCount(t, natsprober.OutcomeSuccessful, 5)
+
+	if err := prober.RemoveResponseSubject("_INBOX.>"); err != nil {
+		t.Fatalf("Can't remove response subject: %v", err)
+	}
+	publish(singleToken)
+	publish(muxed)
+	recorder.WaitCount(t, natsprober.OutcomeSuccessful, 15)
+
+	// Inbox subscriptions overlapping with added subject are dropped
+	if err := prober.AddResponseSubject("_INBOX.>"); err != nil {
+		t.Fatalf("Can't add response subject: %v", err)
+	}
+	if subjects := prober.Stats().AutoResponseSubjects; len(subjects) != 0 {
+		t.Errorf("Wrong auto response subjects %v", subjects)
+	}
+	publish(singleToken)
+	publish(muxed)
+	recorder.WaitCount(t, natsprober.OutcomeSuccessful, 25)
+
+	time.Sleep(time.Millisecond * 100)
+	recorder.AssertCounts(t, map[natsprober.Outcome]int{
+		natsprober.OutcomeSuccessful: 25,
+	})
+}
+
+func TestProberSyntheticProbes(t *testing.T) {
+	server := testutil.RunServer(t)
+	testutil.StartFakeService(t, testutil.Connect(t, server), "svc.echo",
+		testutil.Behavior{},
+		testutil.Behavior{},
+		testutil.Behavior{Drop: true},
+	)
+	recorder := startProber(t, testutil.Connect(t, server), &natsprober.NatsProber{
+		RequestSubjects:          []string{"svc.>"},
+		ResponseSubjects:         []string{"_INBOX.>"},
+		RequestTimeout:           time.Millisecond * 100,
+		WorkersCount:             1,
+		WorkerMaxPendingRequests: 100,
+		SyntheticProbes: []natsprober.SyntheticProbe{{
+			Subject: "svc.echo",
+			Payload: `{"seq": {{.Seq}}}`,
+			Headers: map[string]string{"Probe-Seq": "{{.Seq}}"},
+			Rate:    50,
+			Jitter:  time.Millisecond * 5,
+		}},
+	})
+
+	recorder.WaitCount(t, natsprober.OutcomeSuccessful, 2)
+	recorder.WaitCount(t, natsprober.OutcomeTimeouted, 1)
+
+	// Service replies only to the first two requests
+	successful := recorder.Events(natsprober.OutcomeSuccessful)
+	if len(successful) != 2 {
+		t.Fatalf("Wrong number of successful outcomes %d", len(successful))
+	}
+	for i, event := range successful {
+		if !event.Synthetic {
+			t.Errorf("Outcome of synthetic request must be marked as synthetic")
+		}
+		if seq := event.RequestHeaders.Get("Probe-Seq"); seq != strconv.Itoa(i+1) {
+			t.Errorf("Wrong templated header %s", seq)
+		}
+		if event.RequestSize != len(`{"seq": 1}`) {
+			t.Errorf("Wrong templated payload size %d", event.RequestSize)
+		}
+	}
+	for _, event := range recorder.Events(natsprober.OutcomeTimeouted) {
+		if !event.Synthetic {
+			t.Errorf("Outcome of synthetic request must be marked as synthetic")
+		}
+	}
+	if n := recorder.Count(natsprober.OutcomeUnknown); n != 0 {
+		t.Errorf("Passive subscriptions must ignore synthetic traffic, got %d unknown", n)
+	}
+}
+
+func TestProberSyntheticPublishFailure(t *testing.T) {
+	server := testutil.RunServer(t)
+	recorder := startProber(t, testutil.Connect(t, server), &natsprober.NatsProber{
+		RequestTimeout:           time.Millisecond * 50,
+		WorkersCount:             1,
+		WorkerMaxPendingRequests: 100,
+		SyntheticProbes: []natsprober.SyntheticProbe{{
+			Subject: "svc.echo",
+			// Exceeds server's max payload, so publish fails
+			Payload: strings.Repeat("x", 2*1024*1024),
+			Rate:    50,
+		}},
+	})
+
+	recorder.WaitCount(t, natsprober.OutcomeDropped, 2)
+	for _, event := range recorder.Events(natsprober.OutcomeDropped) {
+		if event.DropReason != natsprober.DropReasonPublishFailed || !event.Synthetic {
+			t.Errorf("Wrong dropped event reason %s, synthetic %v", event.DropReason, event.Synthetic)
+		}
+	}
+	time.Sleep(time.Millisecond * 100)
+	if n := recorder.Count(natsprober.OutcomeTimeouted); n != 0 {
+		t.Errorf("Requests that failed to be published must not time out, got %d timeouted", n)
+	}
+}
+
+func TestProberNoResponders(t *testing.T) {
+	server := testutil.RunServer(t)
+	recorder := startProber(t, testutil.Connect(t, server), &natsprober.NatsProber{
+		RequestTimeoutSeconds:    10,
+		WorkersCount:             1,
+		WorkerMaxPendingRequests: 100,
+		SyntheticProbes: []natsprober.SyntheticProbe{{
+			Subject: "svc.missing",
+			Rate:    100,
+		}},
+	})
+
+	recorder.WaitCount(t, natsprober.OutcomeNoResponders, 2)
+	if n := recorder.Count(natsprober.OutcomeSuccessful); n != 0 {
+		t.Errorf("No responders status counted as %d successful responses", n)
+	}
+	if event := recorder.Events(natsprober.OutcomeNoResponders)[0]; event.Status != natsprober.StatusNoResponders || event.RequestSubject != "svc.missing" {
+		t.Errorf("Wrong no responders event %+v", event)
+	}
+}
+
+func TestProberStats(t *testing.T) {
+	server := testutil.RunServer(t)
+	client := testutil.Connect(t, server)
+	testutil.StartFakeService(t, testutil.Connect(t, server), "svc.echo",
+		testutil.Behavior{},
+		testutil.Behavior{Drop: true},
+	)
+	prober := &natsprober.NatsProber{
+		RequestSubjects:          []string{"svc.>"},
+		ResponseSubjects:         []string{"_INBOX.>", "other.>"},
+		RequestTimeoutSeconds:    10,
+		WorkersCount:             2,
+		WorkerMaxPendingRequests: 100,
+		OrphanResponseGrace:      time.Millisecond * 50,
+		StatsSubject:             natsprober.DefaultStatsSubject,
+	}
+	recorder := startProber(t, testutil.Connect(t, server), prober)
+	if err := prober.RemoveResponseSubject("other.>"); err != nil {
+		t.Fatalf("Can't remove response subject: %v", err)
+	}
+
+	publishRequests(t, client, "svc.echo", 5)
+	recorder.WaitCount(t, natsprober.OutcomeSuccessful, 1)
+
+	var stats natsprober.Stats
+	deadline := time.Now().Add(testutil.DefaultTimeout)
+	for stats.Pending != 4 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Wrong pending count %d", stats.Pending)
+		}
+		msg, err := client.Request(natsprober.DefaultStatsSubject, nil, testutil.DefaultTimeout)
+		if err != nil {
+			t.Fatalf("Can't request stats: %v", err)
+		}
+		if err := json.Unmarshal(msg.Data, &stats); err != nil {
+			t.Fatalf("Can't parse stats: %v", err)
+		}
+	}
+
+	// Replies to stats requests themselves are seen as unknown responses
+	if stats.Outcomes[natsprober.OutcomeSuccessful] != 1 || stats.Outcomes[natsprober.OutcomeTimeouted] != 0 {
+		t.Errorf("Wrong outcomes %v", stats.Outcomes)
+	}
+	if len(stats.Workers) != 2 || stats.Workers[0].Pending+stats.Workers[1].Pending != 4 {
+		t.Errorf("Wrong worker stats %+v", stats.Workers)
+	}
+	if stats.PendingBytes == 0 || stats.OldestPendingAge <= 0 {
+		t.Errorf("Wrong pending bytes %d and age %v", stats.PendingBytes, stats.OldestPendingAge)
+	}
+	if len(stats.UnsubscribedSubjects) != 1 || stats.UnsubscribedSubjects[0] != "other.>" {
+		t.Errorf("Wrong unsubscribed subjects %v", stats.UnsubscribedSubjects)
+	}
+}
+
+func TestProberDrainOnStop(t *testing.T) {
+	server := testutil.RunServer(t)
+	client := testutil.Connect(t, server)
+	testutil.StartFakeService(t, testutil.Connect(t, server), "svc.echo", testutil.Behavior{Latency: time.Millisecond * 100})
+	prober := &natsprober.NatsProber{
+		RequestSubjects:          []string{"svc.>"},
+		ResponseSubjects:         []string{"_INBOX.>"},
+		RequestTimeoutSeconds:    10,
+		WorkersCount:             2,
+		WorkerMaxPendingRequests: 100,
+		DrainOnStop:              true,
+	}
+	recorder := startProber(t, testutil.Connect(t, server), prober)
+
+	publishRequests(t, client, "svc.echo", 3)
+	for i := 0; i < 2; i++ {
+		if err := client.PublishRequest("svc.silent", "_INBOX.silent."+strconv.Itoa(i), nil); err != nil {
+			t.Fatalf("Can't publish request: %v", err)
+		}
+	}
+	testutil.Flush(t, client)
+
+	deadline := time.Now().Add(testutil.DefaultTimeout)
+	for prober.Stats().Pending+recorder.Count(natsprober.OutcomeSuccessful) != 5 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Requests were not received")
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*500)
+	defer cancel()
+	start := time.Now()
+	if err := prober.Stop(ctx); err != nil {
+		t.Fatalf("Can't stop prober: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Millisecond*400 || elapsed > time.Second {
+		t.Errorf("Wrong drain duration %v", elapsed)
+	}
+	recorder.AssertCounts(t, map[natsprober.Outcome]int{
+		natsprober.OutcomeSuccessful: 3,
+		natsprober.OutcomeAbandoned:  2,
+	})
+	if err := prober.Stop(context.Background()); err != nil {
+		t.Errorf("Repeated stop failed: %v", err)
+	}
+}
+
+func TestProberPublishes(t *testing.T) {
+	server := testutil.RunServer(t)
+	client := testutil.Connect(t, server)
+	testutil.StartFakeService(t, testutil.Connect(t, server), "svc.echo", testutil.Behavior{})
+	recorder := startProber(t, testutil.Connect(t, server), &natsprober.NatsProber{
+		RequestSubjects:          []string{"svc.>"},
+		ResponseSubjects:         []string{"_INBOX.>"},
+		RequestTimeout:           time.Millisecond * 100,
+		WorkersCount:             2,
+		WorkerMaxPendingRequests: 100,
+		OrphanResponseGrace:      time.Millisecond * 50,
+	})
+
+	for i := 0; i < 3; i++ {
+		if err := client.Publish("svc.events", []byte("event")); err != nil {
+			t.Fatalf("Can't publish: %v", err)
+		}
+	}
+	publishRequests(t, client, "svc.echo", 2)
+
+	recorder.WaitCount(t, natsprober.OutcomePublish, 3)
+	recorder.WaitCount(t, natsprober.OutcomeSuccessful, 2)
+	// Publishes must not be kept pending and time out
+	time.Sleep(time.Millisecond * 200)
+	recorder.AssertCounts(t, map[natsprober.Outcome]int{
+		natsprober.OutcomePublish:    3,
+		natsprober.OutcomeSuccessful: 2,
+		natsprober.OutcomeTimeouted:  0,
+	})
+	if event := recorder.Events(natsprober.OutcomePublish)[0]; event.RequestSubject != "svc.events" || event.RequestSize != 5 {
+		t.Errorf("Wrong publish event %+v", event)
+	}
+}
+
+func TestProberControlWhileInFlight(t *testing.T) {
+	server := testutil.RunServer(t)
+	client := testutil.Connect(t, server)
+	service := testutil.Connect(t, server)
+	testutil.StartFakeService(t, service, "svc.a", testutil.Behavior{Latency: time.Millisecond * 100})
+	testutil.StartFakeService(t, service, "svc.b", testutil.Behavior{Latency: time.Millisecond * 100})
+	recorder := startProber(t, testutil.Connect(t, server), &natsprober.NatsProber{
+		RequestSubjects: []string{"svc.a"},
+		// Not covering inboxes of control requests
+		ResponseSubjects:         []string{"reply.>"},
+		RequestTimeout:           time.Second * 2,
+		WorkersCount:             2,
+		WorkerMaxPendingRequests: 100,
+		ControlSubject:           "$PROBER.CONTROL",
+		OrphanResponseGrace:      time.Millisecond * 50,
+	})
+
+	control := func(command string, subject string) {
+		t.Helper()
+		data, _ := json.Marshal(&natsprober.ControlCommand{Command: command, Subject: subject})
+		msg, err := client.Request("$PROBER.CONTROL", data, testutil.DefaultTimeout)
+		if err != nil {
+			t.Fatalf("Control request failed: %v", err)
+		}
+		var reply natsprober.ControlReply
+		if err := json.Unmarshal(msg.Data, &reply); err != nil || len(reply.Error) > 0 {
+			t.Fatalf("Control command %s %s failed: %v %s", command, subject, err, reply.Error)
+		}
+	}
+	publish := func(subject string, reply string) {
+		t.Helper()
+		if err := client.PublishRequest(subject, reply, nil); err != nil {
+			t.Fatalf("Can't publish request: %v", err)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		publish("svc.a", "reply.a."+strconv.Itoa(i))
+	}
+	testutil.Flush(t, client)
+	// Requests to svc.a are pending while subjects change
+	control("add_request_subject", "svc.b")
+	control("add_response_subject", "other.>")
+	control("remove_response_subject", "other.>")
+	control("remove_request_subject", "svc.a")
+	for i := 0; i < 5; i++ {
+		publish("svc.b", "reply.b."+strconv.Itoa(i))
+	}
+	testutil.Flush(t, client)
+
+	recorder.WaitCount(t, natsprober.OutcomeSuccessful, 10)
+	// Requests to removed subject are no longer observed, their responses are unknown
+	publish("svc.a", "reply.a.late")
+	testutil.Flush(t, client)
+	recorder.WaitCount(t, natsprober.OutcomeUnknown, 1)
+	recorder.AssertCounts(t, map[natsprober.Outcome]int{
+		natsprober.OutcomeSuccessful: 10,
+		natsprober.OutcomeUnknown:    1,
+	})
+}
@@ -0,0 +1,139 @@
+package natsprober
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Stage is a step of Pipeline. It may modify event, e.g. set its Labels,
+// and returns false to keep it from handlers and subscribers.
+type Stage interface {
+	Process(event *ProbeEvent) bool
+}
+
+// StageFunc adapts a function to Stage.
+type StageFunc func(event *ProbeEvent) bool
+
+func (f StageFunc) Process(event *ProbeEvent) bool {
+	return f(event)
+}
+
+// ForOutcomes applies stage to events of the given outcomes only, passing other events as is.
+func ForOutcomes(stage Stage, outcomes ...Outcome) Stage {
+	filter := OutcomeFilter(outcomes...)
+	return StageFunc(func(event *ProbeEvent) bool {
+		return !filter(event) || stage.Process(event)
+	})
+}
+
+// runPipeline applies Pipeline stages in order, reporting whether event passed all of them.
+func (prober *NatsProber) runPipeline(event *ProbeEvent) bool {
+	for _, stage := range prober.Pipeline {
+		if !stage.Process(event) {
+			return false
+		}
+	}
+	return true
+}
+
+// SubjectFilterStage passes events with request subject (reply subject for unknown responses)
+// matching any of Subjects patterns, or only ones matching none of them with Exclude.
+type SubjectFilterStage struct {
+	Subjects []string
+	Exclude  bool
+}
+
+func (s SubjectFilterStage) Process(event *ProbeEvent) bool {
+	subject := event.RequestSubject
+	if len(subject) == 0 {
+		subject = event.ReplySubject
+	}
+	for _, pattern := range s.Subjects {
+		if matchSubject(pattern, subject) {
+			return !s.Exclude
+		}
+	}
+	return s.Exclude
+}
+
+// HeaderLabelsStage sets event Labels from headers, mapping label names to header names.
+// Request headers take precedence over response ones, labels of missing headers are not set.
+type HeaderLabelsStage struct {
+	Labels map[string]string
+}
+
+func (s HeaderLabelsStage) Process(event *ProbeEvent) bool {
+	for label, header := range s.Labels {
+		value := event.RequestHeaders.Get(header)
+		if len(value) == 0 {
+			value = event.ResponseHeaders.Get(header)
+		}
+		if len(value) == 0 {
+			continue
+		}
+		if event.Labels == nil {
+			event.Labels = make(map[string]string, len(s.Labels))
+		}
+		event.Labels[label] = value
+	}
+	return true
+}
+
+// SampleStage passes a random Rate fraction of events, e.g. 0.01 for 1 in 100.
+type SampleStage struct {
+	Rate float64
+}
+
+func (s SampleStage) Process(_ *ProbeEvent) bool {
+	return rand.Float64() < s.Rate
+}
+
+// RateLimitStage passes up to Rate events per second on average, with bursts of up to Burst
+// events (1 if not set). Its fields must not be changed once it's used.
+type RateLimitStage struct {
+	Rate  float64
+	Burst uint
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func (s *RateLimitStage) Process(_ *ProbeEvent) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	burst := float64(s.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	now := time.Now()
+	if s.last.IsZero() {
+		s.tokens = burst
+	} else {
+		s.tokens = math.Min(burst, s.tokens+now.Sub(s.last).Seconds()*s.Rate)
+	}
+	s.last = now
+	if s.tokens < 1 {
+		return false
+	}
+	s.tokens--
+	return true
+}
+
+// LatencyThresholdStage passes events with Latency of at least MinLatency, e.g. to keep
+// only slow responses. Events of outcomes without latency, such as timeouted, are passed.
+type LatencyThresholdStage struct {
+	MinLatency time.Duration
+}
+
+func (s LatencyThresholdStage) Process(event *ProbeEvent) bool {
+	switch event.Outcome {
+	case OutcomeSuccessful, OutcomeInvalid, OutcomeNoResponders, OutcomeGatheredResponse, OutcomeGatherCompleted:
+		return event.Latency >= s.MinLatency
+	default:
+		return true
+	}
+}
@@ -0,0 +1,92 @@
+package natsprober
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestPipelineStages(t *testing.T) {
+	filter := SubjectFilterStage{Subjects: []string{"svc.>"}}
+	if !filter.Process(&ProbeEvent{RequestSubject: "svc.get"}) || filter.Process(&ProbeEvent{RequestSubject: "other"}) {
+		t.Error("Wrong subject filter")
+	}
+	if !filter.Process(&ProbeEvent{Outcome: OutcomeUnknown, ReplySubject: "svc.reply"}) {
+		t.Error("Unknown responses must be filtered by reply subject")
+	}
+	filter.Exclude = true
+	if filter.Process(&ProbeEvent{RequestSubject: "svc.get"}) || !filter.Process(&ProbeEvent{RequestSubject: "other"}) {
+		t.Error("Wrong excluding subject filter")
+	}
+
+	event := &ProbeEvent{
+		RequestHeaders:  nats.Header{"Tenant": []string{"a"}},
+		ResponseHeaders: nats.Header{"Tenant": []string{"b"}, "Region": []string{"eu"}},
+	}
+	HeaderLabelsStage{Labels: map[string]string{"tenant": "Tenant", "region": "Region", "zone": "Zone"}}.Process(event)
+	if len(event.Labels) != 2 || event.Labels["tenant"] != "a" || event.Labels["region"] != "eu" {
+		t.Errorf("Wrong labels %v", event.Labels)
+	}
+
+	if (SampleStage{Rate: 0}).Process(event) || !(SampleStage{Rate: 1}).Process(event) {
+		t.Error("Wrong sampling")
+	}
+
+	limiter := &RateLimitStage{Rate: 0.001, Burst: 2}
+	if !limiter.Process(event) || !limiter.Process(event) || limiter.Process(event) {
+		t.Error("Wrong rate limit burst")
+	}
+
+	threshold := LatencyThresholdStage{MinLatency: time.Millisecond * 10}
+	if threshold.Process(&ProbeEvent{Outcome: OutcomeSuccessful, Latency: time.Millisecond}) {
+		t.Error("Fast response passed latency threshold")
+	}
+	if !threshold.Process(&ProbeEvent{Outcome: OutcomeSuccessful, Latency: time.Millisecond * 10}) {
+		t.Error("Slow response didn't pass latency threshold")
+	}
+	if !threshold.Process(&ProbeEvent{Outcome: OutcomeTimeouted}) {
+		t.Error("Timeouted request didn't pass latency threshold")
+	}
+}
+
+func TestPipelineAppliesToAllOutcomes(t *testing.T) {
+	prober := &NatsProber{
+		RequestTimeoutSeconds:    10,
+		WorkerMaxPendingRequests: 10,
+		Pipeline: []Stage{
+			SubjectFilterStage{Subjects: []string{"svc"}},
+			ForOutcomes(SampleStage{Rate: 0}, OutcomeSuccessful),
+			HeaderLabelsStage{Labels: map[string]string{"tenant": "Tenant"}},
+		},
+	}
+	successful := 0
+	prober.SetSuccessfulResponseHandler(func(_ *NatsMessage, _ *NatsMessage) {
+		successful++
+	})
+	var events []*ProbeEvent
+	prober.SetEventHandler(func(event *ProbeEvent) {
+		events = append(events, event)
+	})
+	w := newTestWorker(prober)
+
+	now := time.Now()
+	w.handleRequest(testRequest("a", now))
+	w.handleResponse(testResponse("a", now))
+	other := testSubjectRequest("other", "b", now)
+	w.handleRequest(other)
+	w.handleResponse(testResponse("b", now))
+	dropped := testRequest("c", now)
+	dropped.Msg.Header = nats.Header{"Tenant": []string{"x"}}
+	prober.reportDropped(dropped, DropReasonCapacity)
+
+	if successful != 0 {
+		t.Errorf("Sampled out responses passed to handler: %d", successful)
+	}
+	if len(events) != 1 || events[0].Outcome != OutcomeDropped || events[0].Labels["tenant"] != "x" {
+		t.Errorf("Wrong events passed %+v", events)
+	}
+	if count := prober.counters.outcomes[OutcomeSuccessful]; count != 2 {
+		t.Errorf("Filtered outcomes must still be counted, got %d", count)
+	}
+}
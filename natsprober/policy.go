@@ -0,0 +1,106 @@
+package natsprober
+
+import (
+	"fmt"
+	"time"
+)
+
+// DropPolicy decides which request is dropped when pending requests limit is reached.
+type DropPolicy int
+
+const (
+	// DropOldest evicts the oldest pending request to make room for the new one.
+	DropOldest DropPolicy = iota
+	// DropNewest drops the new request, keeping pending ones.
+	DropNewest
+	// RejectNew rejects the new request without reporting it to dropped handler,
+	// only counting it in metrics.
+	RejectNew
+	// DropSample admits the new request with probability of the sample rate
+	// by evicting the oldest pending request, otherwise drops the new one.
+	DropSample
+)
+
+// DropReason tells why a message was dropped.
+type DropReason string
+
+const (
+	// DropReasonCapacity is reported for requests dropped due to pending requests limit.
+	DropReasonCapacity DropReason = "capacity"
+	// DropReasonSampledOut is reported for new requests not chosen by DropSample policy.
+	DropReasonSampledOut DropReason = "sampled_out"
+	// DropReasonMemory is reported for requests dropped due to pending bytes budgets.
+	DropReasonMemory DropReason = "memory"
+	// DropReasonRequestQueueOverflow is reported in NonBlockingEnqueue mode for requests
+	// that didn't fit into worker's queue.
+	DropReasonRequestQueueOverflow DropReason = "request_queue_overflow"
+	// DropReasonResponseQueueOverflow is reported in NonBlockingEnqueue mode for responses
+	// that didn't fit into worker's queue. The matching request will likely time out.
+	DropReasonResponseQueueOverflow DropReason = "response_queue_overflow"
+	// DropReasonPublishFailed is reported for synthetic requests that failed to be published.
+	DropReasonPublishFailed DropReason = "publish_failed"
+)
+
+var dropPolicies = []DropPolicy{DropOldest, DropNewest, RejectNew, DropSample}
+
+func (policy DropPolicy) String() string {
+	switch policy {
+	case DropOldest:
+		return "drop_oldest"
+	case DropNewest:
+		return "drop_newest"
+	case RejectNew:
+		return "reject"
+	case DropSample:
+		return "sample"
+	default:
+		return fmt.Sprintf("DropPolicy(%d)", int(policy))
+	}
+}
+
+// ParseDropPolicy parses drop policy from its String() form.
+func ParseDropPolicy(s string) (DropPolicy, error) {
+	for _, policy := range dropPolicies {
+		if policy.String() == s {
+			return policy, nil
+		}
+	}
+	return DropOldest, fmt.Errorf("unknown drop policy '%s'", s)
+}
+
+// SubjectPolicy overrides timeout and capacity for requests with subjects matching
+// Subject pattern (with "*" and ">" wildcards). Zero Timeout means prober's default
+// timeout and zero MaxPending means no per-subject limit (per worker, as WorkerMaxPendingRequests).
+// SampleRate is only used with DropSample policy.
+type SubjectPolicy struct {
+	Subject    string
+	Timeout    time.Duration
+	MaxPending uint
+	DropPolicy DropPolicy
+	SampleRate float64
+}
+
+// policyIndex returns index of the first policy matching subject,
+// or len(prober.Policies) for the default policy.
+func (prober *NatsProber) policyIndex(subject string) int {
+	for i := range prober.Policies {
+		if matchSubject(prober.Policies[i].Subject, subject) {
+			return i
+		}
+	}
+	return len(prober.Policies)
+}
+
+// requestTimeout returns how long requests under given policy are kept pending.
+func (prober *NatsProber) requestTimeout(policyIndex int) time.Duration {
+	if policyIndex < len(prober.Policies) && prober.Policies[policyIndex].Timeout > 0 {
+		return prober.Policies[policyIndex].Timeout
+	}
+	if prober.GatherResponses && prober.GatherWindow > 0 {
+		return prober.GatherWindow
+	}
+	if prober.RequestTimeout > 0 {
+		return prober.RequestTimeout
+	}
+	return time.Duration(prober.RequestTimeoutSeconds) * time.Second
+}
@@ -0,0 +1,233 @@
+package natsprober
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultAutoscaleInterval        = time.Second
+	defaultAutoscaleSustainedChecks = 5
+)
+
+// keyHash is a deterministic hash of correlation key.
+func keyHash(key string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	return hash.Sum64()
+}
+
+// mix64 is the splitmix64 finalizer.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// rendezvousOwner returns index of the candidate with the highest score for key hash
+// (rendezvous hashing): when candidates are added or removed, only keys owned by
+// affected candidates change their owner.
+func rendezvousOwner(hash uint64, candidates []uint64) int {
+	best, bestScore := 0, uint64(0)
+	for i, candidate := range candidates {
+		if score := mix64(hash ^ mix64(candidate)); i == 0 || score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
+
+func workerIDs(workers []*worker) []uint64 {
+	ids := make([]uint64, len(workers))
+	for i, w := range workers {
+		ids[i] = w.id
+	}
+	return ids
+}
+
+// getWorker must be called under workersMu read lock.
+func (prober *NatsProber) getWorker(key string) *worker {
+	return prober.workers[rendezvousOwner(keyHash(key), prober.workerIDs)]
+}
+
+func (prober *NatsProber) startWorker() *worker {
+	prober.lastWorkerID++
+	return startWorker(prober, prober.lastWorkerID)
+}
+
+func (prober *NatsProber) startWorkers() {
+	prober.workersMu.Lock()
+	defer prober.workersMu.Unlock()
+	for i := 0; i < int(prober.WorkersCount); i++ {
+		prober.workers = append(prober.workers, prober.startWorker())
+	}
+	prober.workerIDs = workerIDs(prober.workers)
+}
+
+// Resize changes number of workers while prober is running. Pending requests and
+// orphan responses whose owner changes are migrated, so no state is lost. Incoming messages
+// are held back during migration.
+func (prober *NatsProber) Resize(workersCount uint) error {
+	if workersCount == 0 {
+		return fmt.Errorf("workers count must be positive")
+	}
+
+	prober.workersMu.Lock()
+	defer prober.workersMu.Unlock()
+
+	oldWorkers := prober.workers
+	if int(workersCount) == len(oldWorkers) {
+		return nil
+	}
+	log.Printf("NatsProber: resizing from %d to %d workers...", len(oldWorkers), workersCount)
+
+	newWorkers := append([]*worker(nil), oldWorkers...)
+	for len(newWorkers) < int(workersCount) {
+		newWorkers = append(newWorkers, prober.startWorker())
+	}
+	removedWorkers := newWorkers[workersCount:]
+	newWorkers = newWorkers[:workersCount]
+	newIDs := workerIDs(newWorkers)
+
+	// Extract in parallel: each worker first handles its queued messages
+	moved := make([][]*pendingRequest, len(oldWorkers))
+	movedOrphans := make([][]*NatsMessage, len(oldWorkers))
+	var wg sync.WaitGroup
+	for i, w := range oldWorkers {
+		wg.Add(1)
+		go func(i int, w *worker) {
+			defer wg.Done()
+			move := func(key string) bool {
+				return newIDs[rendezvousOwner(keyHash(key), newIDs)] != w.id
+			}
+			moved[i] = w.extract(move)
+			movedOrphans[i] = w.extractOrphans(move)
+		}(i, w)
+	}
+	wg.Wait()
+
+	adopted := make([][]*pendingRequest, len(newWorkers))
+	for _, entries := range moved {
+		for _, pending := range entries {
+			owner := rendezvousOwner(keyHash(pending.request.Key), newIDs)
+			adopted[owner] = append(adopted[owner], pending)
+		}
+	}
+	adoptedOrphans := make([][]*NatsMessage, len(newWorkers))
+	for _, orphans := range movedOrphans {
+		for _, orphan := range orphans {
+			owner := rendezvousOwner(keyHash(orphan.Key), newIDs)
+			adoptedOrphans[owner] = append(adoptedOrphans[owner], orphan)
+		}
+	}
+	for i, w := range newWorkers {
+		if len(adopted[i]) > 0 || len(adoptedOrphans[i]) > 0 {
+			w.adopt(adopted[i], adoptedOrphans[i])
+		}
+	}
+
+	for _, w := range removedWorkers {
+		w.stop()
+	}
+
+	prober.workers = newWorkers
+	prober.workerIDs = newIDs
+	return nil
+}
+
+// CurrentWorkersCount returns number of workers, which may differ from WorkersCount after Resize.
+func (prober *NatsProber) CurrentWorkersCount() int {
+	prober.workersMu.RLock()
+	defer prober.workersMu.RUnlock()
+	return len(prober.workers)
+}
+
+// PendingBytes returns estimated bytes of requests and orphan responses pending in all workers,
+// as limited by MaxPendingBytes.
+func (prober *NatsProber) PendingBytes() int64 {
+	return atomic.LoadInt64(&prober.pendingBytes)
+}
+
+func (prober *NatsProber) workersSnapshot() []*worker {
+	prober.workersMu.RLock()
+	defer prober.workersMu.RUnlock()
+	return append([]*worker(nil), prober.workers...)
+}
+
+// autoscaler adds a worker when average backlog of workers' queues
+// stays above threshold for the given number of consecutive checks.
+type autoscaler struct {
+	prober *NatsProber
+
+	stopChan chan bool
+	wg       sync.WaitGroup
+}
+
+func startAutoscaler(prober *NatsProber) *autoscaler {
+	a := &autoscaler{
+		prober:   prober,
+		stopChan: make(chan bool),
+	}
+	a.wg.Add(1)
+	go a.run()
+	return a
+}
+
+func (a *autoscaler) stop() {
+	a.stopChan <- true
+	a.wg.Wait()
+}
+
+func (a *autoscaler) run() {
+	defer a.wg.Done()
+
+	interval := a.prober.AutoscaleInterval
+	if interval <= 0 {
+		interval = defaultAutoscaleInterval
+	}
+	sustainedChecks := a.prober.AutoscaleSustainedChecks
+	if sustainedChecks == 0 {
+		sustainedChecks = defaultAutoscaleSustainedChecks
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var highChecks uint
+	for {
+		select {
+		case <-ticker.C:
+		case <-a.stopChan:
+			return
+		}
+
+		workers := a.prober.workersSnapshot()
+		if len(workers) >= int(a.prober.AutoscaleMaxWorkers) {
+			highChecks = 0
+			continue
+		}
+		var backlog int
+		for _, w := range workers {
+			backlog += len(w.requests) + len(w.responses)
+		}
+		if backlog/len(workers) < int(a.prober.AutoscaleBacklogThreshold) {
+			highChecks = 0
+			continue
+		}
+		if highChecks++; highChecks < sustainedChecks {
+			continue
+		}
+
+		highChecks = 0
+		if err := a.prober.Resize(uint(len(workers) + 1)); err != nil {
+			log.Printf("NatsProber: can't autoscale: %v", err)
+		}
+	}
+}
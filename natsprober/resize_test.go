@@ -0,0 +1,133 @@
+package natsprober
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestRendezvousOwnerStability(t *testing.T) {
+	before := []uint64{1, 2, 3}
+	after := []uint64{1, 2, 3, 4}
+	moved := 0
+	for i := 0; i < 10000; i++ {
+		hash := keyHash(strconv.Itoa(i))
+		oldOwner := before[rendezvousOwner(hash, before)]
+		newOwner := after[rendezvousOwner(hash, after)]
+		if oldOwner != newOwner {
+			if newOwner != 4 {
+				t.Fatalf("Key %d moved from %d to %d instead of the new worker", i, oldOwner, newOwner)
+			}
+			moved++
+		}
+	}
+	if moved < 2000 || moved > 3000 {
+		t.Errorf("Expected ~1/4 of keys to move, got %d", moved)
+	}
+}
+
+func TestResizeKeepsPendingRequests(t *testing.T) {
+	prober := &NatsProber{
+		WorkersCount:             2,
+		WorkerMaxPendingRequests: 10000,
+		RequestTimeout:           time.Minute,
+		Correlator:               ReplySubjectCorrelator{},
+	}
+	var mu sync.Mutex
+	successful, unknown := 0, 0
+	prober.SetSuccessfulResponseHandler(func(*NatsMessage, *NatsMessage) {
+		mu.Lock()
+		successful++
+		mu.Unlock()
+	})
+	prober.SetUnknownResponseHandler(func(*NatsMessage) {
+		mu.Lock()
+		unknown++
+		mu.Unlock()
+	})
+	prober.startWorkers()
+
+	round := func(resizeTo uint) {
+		for i := 0; i < 1000; i++ {
+			prober.handleRequest(&nats.Msg{Subject: "svc", Reply: "_INBOX." + strconv.Itoa(i)})
+		}
+		if err := prober.Resize(resizeTo); err != nil {
+			t.Fatalf("Resize: %s", err)
+		}
+		if prober.CurrentWorkersCount() != int(resizeTo) {
+			t.Fatalf("Wrong workers count %d", prober.CurrentWorkersCount())
+		}
+		for i := 0; i < 1000; i++ {
+			prober.handleResponse(&nats.Msg{Subject: "_INBOX." + strconv.Itoa(i)})
+		}
+	}
+	round(5)
+	round(1)
+	round(3)
+
+	for _, w := range prober.workersSnapshot() {
+		w.execute(w.drainQueues)
+		w.stop()
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if successful != 3000 || unknown != 0 {
+		t.Errorf("Expected 3000 successful responses, got %d successful and %d unknown", successful, unknown)
+	}
+}
+
+func TestResizeMovesOrphanResponses(t *testing.T) {
+	prober := &NatsProber{
+		WorkersCount:             3,
+		WorkerMaxPendingRequests: 1000,
+		RequestTimeout:           time.Minute,
+		OrphanResponseGrace:      time.Minute,
+		Correlator:               ReplySubjectCorrelator{},
+	}
+	var mu sync.Mutex
+	successful, unknown := 0, 0
+	prober.SetSuccessfulResponseHandler(func(*NatsMessage, *NatsMessage) {
+		mu.Lock()
+		successful++
+		mu.Unlock()
+	})
+	prober.SetUnknownResponseHandler(func(*NatsMessage) {
+		mu.Lock()
+		unknown++
+		mu.Unlock()
+	})
+	prober.startWorkers()
+
+	// Responses overtaking their requests are held as orphans
+	for i := 0; i < 40; i++ {
+		prober.handleResponse(&nats.Msg{Subject: "_INBOX." + strconv.Itoa(i)})
+	}
+	if err := prober.Resize(1); err != nil {
+		t.Fatalf("Resize: %s", err)
+	}
+	w := prober.workersSnapshot()[0]
+	w.execute(w.drainQueues)
+	if orphans := w.orphanResponses.Len(); orphans != 40 {
+		t.Errorf("Wrong orphans count %d after resize", orphans)
+	}
+	if prober.PendingBytes() != w.pendingBytes {
+		t.Errorf("Wrong pending bytes %d, remaining worker holds %d", prober.PendingBytes(), w.pendingBytes)
+	}
+
+	for i := 0; i < 40; i++ {
+		prober.handleRequest(&nats.Msg{Subject: "svc", Reply: "_INBOX." + strconv.Itoa(i)})
+	}
+	w.execute(w.drainQueues)
+	w.stop()
+	mu.Lock()
+	defer mu.Unlock()
+	if successful != 40 || unknown != 0 {
+		t.Errorf("Expected 40 successful responses, got %d successful and %d unknown", successful, unknown)
+	}
+	if prober.PendingBytes() != 0 {
+		t.Errorf("Wrong pending bytes %d after matching", prober.PendingBytes())
+	}
+}
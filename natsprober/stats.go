@@ -0,0 +1,193 @@
+package natsprober
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// DefaultStatsSubject is the conventional StatsSubject, to be queried with `nats request`.
+const DefaultStatsSubject = "$PROBER.STATS"
+
+// Stats is a snapshot of prober state returned by NatsProber.Stats.
+type Stats struct {
+	Time time.Time `json:"time"`
+	// Outcomes counts events reported since Start by outcome
+	Outcomes map[Outcome]uint64 `json:"outcomes"`
+	// Rejected counts requests rejected by RejectNew policy, which are not reported as outcomes
+	Rejected uint64 `json:"rejected"`
+
+	Pending          int           `json:"pending"`
+	PendingBytes     int64         `json:"pending_bytes"`
+	OrphanResponses  int           `json:"orphan_responses"`
+	OldestPendingAge time.Duration `json:"oldest_pending_age_ns"`
+	Workers          []WorkerStats `json:"workers"`
+
+	// Outcomes queued for and not passed to asynchronous handlers, see HandlerWorkers
+	HandlerBacklog   int    `json:"handler_backlog,omitempty"`
+	HandlerOverflows uint64 `json:"handler_overflows,omitempty"`
+	// Subscribers of Subscribe with their buffered and dropped events
+	Subscribers []SubscriberStats `json:"subscribers,omitempty"`
+
+	RequestSubjects      []string `json:"request_subjects"`
+	ResponseSubjects     []string `json:"response_subjects"`
+	AutoResponseSubjects []string `json:"auto_response_subjects,omitempty"`
+	// UnsubscribedSubjects are configured request and response subjects removed at runtime
+	UnsubscribedSubjects []string `json:"unsubscribed_subjects,omitempty"`
+	ClusterMembers       []string `json:"cluster_members,omitempty"`
+}
+
+// WorkerStats is a snapshot of a single worker.
+type WorkerStats struct {
+	ID               uint64        `json:"id"`
+	Pending          int           `json:"pending"`
+	PendingBytes     int64         `json:"pending_bytes"`
+	OrphanResponses  int           `json:"orphan_responses"`
+	OldestPendingAge time.Duration `json:"oldest_pending_age_ns"`
+	RequestQueue     int           `json:"request_queue"`
+	ResponseQueue    int           `json:"response_queue"`
+}
+
+// proberCounters counts reported outcomes for Stats.
+type proberCounters struct {
+	mu       sync.Mutex
+	outcomes map[Outcome]uint64
+	rejected uint64
+}
+
+func (c *proberCounters) countOutcome(outcome Outcome) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.outcomes == nil {
+		c.outcomes = make(map[Outcome]uint64)
+	}
+	c.outcomes[outcome]++
+}
+
+func (c *proberCounters) countRejected() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rejected++
+}
+
+func (c *proberCounters) snapshot(stats *Stats) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats.Outcomes = make(map[Outcome]uint64, len(c.outcomes))
+	for outcome, count := range c.outcomes {
+		stats.Outcomes[outcome] = count
+	}
+	stats.Rejected = c.rejected
+}
+
+// Stats returns a snapshot of prober state. Workers are paused together on their own goroutines
+// while it's taken, so that pending figures and outcome counts are consistent with each other,
+// except for drops of NonBlockingEnqueue mode reported from NATS subscription goroutines.
+// Concurrent calls take their snapshots one at a time. It must only be called between Start and Stop, and not from handlers.
+func (prober *NatsProber) Stats() *Stats {
+	stats := &Stats{}
+
+	prober.statsMu.Lock()
+	prober.workersMu.RLock()
+	workers := prober.workers
+	stats.Workers = make([]WorkerStats, len(workers))
+	var paused sync.WaitGroup
+	paused.Add(len(workers))
+	resume := make(chan bool)
+	for i, w := range workers {
+		go func(i int, w *worker) {
+			w.execute(func() {
+				stats.Workers[i] = w.stats(time.Now())
+				paused.Done()
+				<-resume
+			})
+		}(i, w)
+	}
+	paused.Wait()
+	stats.Time = time.Now()
+	prober.counters.snapshot(stats)
+	close(resume)
+	prober.workersMu.RUnlock()
+	prober.statsMu.Unlock()
+
+	for _, w := range stats.Workers {
+		stats.Pending += w.Pending
+		stats.PendingBytes += w.PendingBytes
+		stats.OrphanResponses += w.OrphanResponses
+		if w.OldestPendingAge > stats.OldestPendingAge {
+			stats.OldestPendingAge = w.OldestPendingAge
+		}
+	}
+
+	stats.RequestSubjects, stats.ResponseSubjects = prober.Subjects()
+	stats.UnsubscribedSubjects = append(
+		missingSubjects(prober.RequestSubjects, stats.RequestSubjects),
+		missingSubjects(prober.ResponseSubjects, stats.ResponseSubjects)...,
+	)
+	if prober.dispatcher != nil {
+		stats.HandlerBacklog = prober.dispatcher.backlog()
+		stats.HandlerOverflows = atomic.LoadUint64(&prober.dispatcher.overflows)
+	}
+	stats.Subscribers = prober.subscribers.stats()
+	if prober.inboxes != nil {
+		stats.AutoResponseSubjects = prober.inboxes.subjects()
+	}
+	if prober.cluster != nil {
+		stats.ClusterMembers = prober.ClusterMembers()
+	}
+	return stats
+}
+
+// stats must be called on worker goroutine.
+func (w *worker) stats(now time.Time) WorkerStats {
+	stats := WorkerStats{
+		ID:              w.id,
+		Pending:         w.pendingRequests.Len(),
+		PendingBytes:    w.pendingBytes,
+		OrphanResponses: w.orphanResponses.Len(),
+		RequestQueue:    len(w.requests),
+		ResponseQueue:   len(w.responses),
+	}
+	if oldest, ok := w.pendingRequests.GetFirst(); ok {
+		stats.OldestPendingAge = now.Sub(oldest.request.ReceivedAt)
+	}
+	return stats
+}
+
+func missingSubjects(configured []string, subscribed []string) []string {
+	var missing []string
+	for _, subject := range configured {
+		found := false
+		for _, current := range subscribed {
+			if current == subject {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, subject)
+		}
+	}
+	return missing
+}
+
+func (prober *NatsProber) handleStats(msg *nats.Msg) {
+	prober.handlersWg.Add(1)
+	defer prober.handlersWg.Done()
+
+	if len(msg.Reply) == 0 {
+		return
+	}
+	data, err := json.Marshal(prober.Stats())
+	if err != nil {
+		log.Printf("NatsProber: can't marshal stats: %v", err)
+		return
+	}
+	if err := msg.Respond(data); err != nil {
+		log.Printf("NatsProber: can't send stats: %v", err)
+	}
+}
@@ -0,0 +1,50 @@
+package natsprober
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStatsConcurrent(t *testing.T) {
+	prober := &NatsProber{
+		RequestTimeoutSeconds:    10,
+		WorkersCount:             4,
+		WorkerMaxPendingRequests: 100,
+	}
+	prober.startWorkers()
+	for i := 0; i < 20; i++ {
+		prober.enqueueRequest(testRequest(strconv.Itoa(i), time.Now()))
+	}
+	waitFor(t, "pending requests", func() bool {
+		return pendingCount(prober) == 20
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if stats := prober.Stats(); stats.Pending != 20 {
+					t.Errorf("Wrong pending count %d", stats.Pending)
+					return
+				}
+			}
+		}()
+	}
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		// Not stopping the prober, as its workers would never stop
+		t.Fatal("Concurrent Stats calls deadlocked")
+	}
+	prober.Stop(context.Background())
+}
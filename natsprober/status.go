@@ -0,0 +1,33 @@
+package natsprober
+
+import (
+	"strconv"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Status codes of NATS status messages.
+const (
+	StatusNoResponders = 503
+	StatusTimeout      = 408
+	StatusConflict     = 409
+)
+
+const natsStatusHeader = "Status"
+
+// natsStatus returns code of NATS status message (an empty message with Status header
+// sent by server or JetStream), or 0 for regular messages.
+func natsStatus(msg *nats.Msg) int {
+	if len(msg.Data) > 0 {
+		return 0
+	}
+	status := msg.Header.Get(natsStatusHeader)
+	if len(status) < 3 {
+		return 0
+	}
+	code, err := strconv.Atoi(status[:3])
+	if err != nil {
+		return 0
+	}
+	return code
+}
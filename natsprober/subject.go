@@ -0,0 +1,24 @@
+package natsprober
+
+import "strings"
+
+// matchSubject reports whether subject matches pattern with NATS wildcard semantics:
+// "*" matches exactly one token and ">" matches one or more trailing tokens.
+// Wildcards in subject are matched literally, so it also tells
+// whether subscription on pattern covers subscription on subject.
+func matchSubject(pattern string, subject string) bool {
+	patternTokens := strings.Split(pattern, ".")
+	subjectTokens := strings.Split(subject, ".")
+	for i, token := range patternTokens {
+		if token == ">" {
+			return len(subjectTokens) > i
+		}
+		if i >= len(subjectTokens) {
+			return false
+		}
+		if token != "*" && token != subjectTokens[i] {
+			return false
+		}
+	}
+	return len(patternTokens) == len(subjectTokens)
+}
@@ -0,0 +1,27 @@
+package natsprober
+
+import "testing"
+
+func TestMatchSubject(t *testing.T) {
+	for _, c := range []struct {
+		pattern string
+		subject string
+		match   bool
+	}{
+		{"a.b.c", "a.b.c", true},
+		{"a.b.c", "a.b", false},
+		{"a.b", "a.b.c", false},
+		{"a.*.c", "a.b.c", true},
+		{"a.*", "a.b.c", false},
+		{"a.>", "a.b.c", true},
+		{"a.>", "a", false},
+		{">", "a", true},
+		{"_INBOX.>", "_INBOX.abc.*", true},
+		{"_INBOX.*.*", "_INBOX.abc.*", true},
+		{"_INBOX.abc.x", "_INBOX.abc.*", false},
+	} {
+		if matchSubject(c.pattern, c.subject) != c.match {
+			t.Errorf("matchSubject(%q, %q) != %v", c.pattern, c.subject, c.match)
+		}
+	}
+}
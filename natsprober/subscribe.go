@@ -0,0 +1,141 @@
+package natsprober
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+const defaultSubscriberBufferSize = 100
+
+// EventFilter selects events delivered to a subscriber, nil accepts all events.
+type EventFilter func(event *ProbeEvent) bool
+
+// OutcomeFilter accepts events of the given outcomes.
+func OutcomeFilter(outcomes ...Outcome) EventFilter {
+	return func(event *ProbeEvent) bool {
+		for _, outcome := range outcomes {
+			if event.Outcome == outcome {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// SubscriberStats is a snapshot of a single event subscriber.
+type SubscriberStats struct {
+	ID       uint64 `json:"id"`
+	Buffered int    `json:"buffered"`
+	Dropped  uint64 `json:"dropped"`
+}
+
+type eventSubscriber struct {
+	id      uint64
+	filter  EventFilter
+	events  chan ProbeEvent
+	dropped uint64 // updated atomically
+}
+
+// eventSubscribers fans events out to subscribers. Sends hold read lock,
+// so that channels are only closed when nothing is sent to them.
+type eventSubscribers struct {
+	mu          sync.RWMutex
+	subscribers map[uint64]*eventSubscriber
+	lastID      uint64
+	closed      bool
+}
+
+// Subscribe delivers events accepted by filter to the returned channel, buffering up to
+// SubscriberBufferSize (100 by default) of them. Events that don't fit are dropped for that
+// subscriber only, and counted in Stats and metrics. Events of the same correlation key are
+// delivered in order they were reported. Headers of events are shared and must not be modified.
+// The channel is closed by cancel, or by Stop once all outcomes are reported.
+func (prober *NatsProber) Subscribe(filter EventFilter) (<-chan ProbeEvent, func()) {
+	size := prober.SubscriberBufferSize
+	if size == 0 {
+		size = defaultSubscriberBufferSize
+	}
+	s := &eventSubscriber{
+		filter: filter,
+		events: make(chan ProbeEvent, size),
+	}
+
+	subs := &prober.subscribers
+	subs.mu.Lock()
+	defer subs.mu.Unlock()
+	if subs.closed {
+		close(s.events)
+		return s.events, func() {}
+	}
+	if subs.subscribers == nil {
+		subs.subscribers = make(map[uint64]*eventSubscriber)
+	}
+	subs.lastID++
+	s.id = subs.lastID
+	subs.subscribers[s.id] = s
+	return s.events, func() {
+		subs.remove(s.id)
+	}
+}
+
+func (subs *eventSubscribers) remove(id uint64) {
+	subs.mu.Lock()
+	defer subs.mu.Unlock()
+	if s, ok := subs.subscribers[id]; ok {
+		delete(subs.subscribers, id)
+		close(s.events)
+	}
+}
+
+// close closes channels of all subscribers, and of ones subscribing afterwards.
+func (subs *eventSubscribers) close() {
+	subs.mu.Lock()
+	defer subs.mu.Unlock()
+	for id, s := range subs.subscribers {
+		delete(subs.subscribers, id)
+		close(s.events)
+	}
+	subs.closed = true
+}
+
+func (subs *eventSubscribers) active() bool {
+	subs.mu.RLock()
+	defer subs.mu.RUnlock()
+	return len(subs.subscribers) > 0
+}
+
+// publishEvent sends a copy of event to each subscriber accepting it, without blocking.
+func (prober *NatsProber) publishEvent(event *ProbeEvent) {
+	subs := &prober.subscribers
+	subs.mu.RLock()
+	defer subs.mu.RUnlock()
+	for _, s := range subs.subscribers {
+		if s.filter != nil && !s.filter(event) {
+			continue
+		}
+		select {
+		case s.events <- *event:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+			prober.metrics.observeSubscriberDrop(event.Outcome)
+		}
+	}
+}
+
+func (subs *eventSubscribers) stats() []SubscriberStats {
+	subs.mu.RLock()
+	defer subs.mu.RUnlock()
+	var stats []SubscriberStats
+	for _, s := range subs.subscribers {
+		stats = append(stats, SubscriberStats{
+			ID:       s.id,
+			Buffered: len(s.events),
+			Dropped:  atomic.LoadUint64(&s.dropped),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].ID < stats[j].ID
+	})
+	return stats
+}
@@ -0,0 +1,57 @@
+package natsprober
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSubscribe(t *testing.T) {
+	prober := &NatsProber{
+		RequestTimeoutSeconds:    10,
+		WorkerMaxPendingRequests: 10,
+		SubscriberBufferSize:     2,
+	}
+	all, cancelAll := prober.Subscribe(nil)
+	unknown, cancelUnknown := prober.Subscribe(OutcomeFilter(OutcomeUnknown))
+	defer cancelUnknown()
+	w := newTestWorker(prober)
+
+	now := time.Now()
+	w.handleRequest(testRequest("a", now))
+	w.handleResponse(testResponse("a", now.Add(time.Millisecond)))
+	w.handleResponse(testResponse("b", now))
+	w.handleResponse(testResponse("c", now))
+
+	event := <-all
+	if event.Outcome != OutcomeSuccessful || event.Latency != time.Millisecond {
+		t.Errorf("Wrong first event %v %v", event.Outcome, event.Latency)
+	}
+	if event = <-all; event.ReplySubject != "b" {
+		t.Errorf("Wrong second event %v %s", event.Outcome, event.ReplySubject)
+	}
+	if event = <-unknown; event.ReplySubject != "b" {
+		t.Errorf("Wrong unknown event %s", event.ReplySubject)
+	}
+	if event = <-unknown; event.ReplySubject != "c" {
+		t.Errorf("Wrong unknown event %s", event.ReplySubject)
+	}
+
+	stats := prober.subscribers.stats()
+	if len(stats) != 2 || stats[0].Dropped != 1 || stats[1].Dropped != 0 {
+		t.Errorf("Wrong subscriber stats %+v", stats)
+	}
+
+	cancelAll()
+	cancelAll()
+	if _, ok := <-all; ok {
+		t.Errorf("Channel must be closed on cancel")
+	}
+	prober.subscribers.close()
+	if _, ok := <-unknown; ok {
+		t.Errorf("Channel must be closed on stop")
+	}
+	late, _ := prober.Subscribe(nil)
+	if _, ok := <-late; ok {
+		t.Errorf("Channel must be closed when subscribing after stop")
+	}
+}
@@ -0,0 +1,135 @@
+package natsprober
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+)
+
+var errNotStarted = errors.New("prober is not started")
+
+// subscriptionSet is a set of subscriptions keyed by subject, safe for concurrent use.
+// Zero value is an empty set.
+type subscriptionSet struct {
+	mu   sync.Mutex
+	subs map[string]*nats.Subscription
+}
+
+func (set *subscriptionSet) add(subject string, subscribe func(subject string) (*nats.Subscription, error)) error {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	if set.subs == nil {
+		set.subs = make(map[string]*nats.Subscription)
+	}
+	if _, ok := set.subs[subject]; ok {
+		return fmt.Errorf("already subscribed to '%s'", subject)
+	}
+	sub, err := subscribe(subject)
+	if err != nil {
+		return err
+	}
+	set.subs[subject] = sub
+	return nil
+}
+
+func (set *subscriptionSet) remove(subject string) error {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	sub, ok := set.subs[subject]
+	if !ok {
+		return fmt.Errorf("not subscribed to '%s'", subject)
+	}
+	delete(set.subs, subject)
+	return sub.Unsubscribe()
+}
+
+func (set *subscriptionSet) removeAll() error {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	var unsubErr error
+	for subject, sub := range set.subs {
+		if err := sub.Unsubscribe(); err != nil {
+			unsubErr = err
+		}
+		delete(set.subs, subject)
+	}
+	return unsubErr
+}
+
+func (set *subscriptionSet) subjects() []string {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	subjects := make([]string, 0, len(set.subs))
+	for subject := range set.subs {
+		subjects = append(subjects, subject)
+	}
+	sort.Strings(subjects)
+	return subjects
+}
+
+// covers reports whether any of subscriptions receives messages published to subject.
+func (set *subscriptionSet) covers(subject string) bool {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	for pattern := range set.subs {
+		if matchSubject(pattern, subject) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddRequestSubject subscribes to requests on subject while prober is running.
+func (prober *NatsProber) AddRequestSubject(subject string) error {
+	if prober.natsConn == nil {
+		return errNotStarted
+	}
+	return prober.requestSubs.add(subject, func(subject string) (*nats.Subscription, error) {
+		return prober.subscribe(subject, prober.handleRequest)
+	})
+}
+
+// RemoveRequestSubject unsubscribes from requests on subject, already pending requests are kept.
+func (prober *NatsProber) RemoveRequestSubject(subject string) error {
+	return prober.requestSubs.remove(subject)
+}
+
+// AddResponseSubject subscribes to responses on subject while prober is running.
+func (prober *NatsProber) AddResponseSubject(subject string) error {
+	if prober.natsConn == nil {
+		return errNotStarted
+	}
+	err := prober.responseSubs.add(subject, func(subject string) (*nats.Subscription, error) {
+		return prober.subscribe(subject, prober.handleResponse)
+	})
+	if err != nil {
+		return err
+	}
+	return prober.updateInboxCoverage()
+}
+
+// RemoveResponseSubject unsubscribes from responses on subject,
+// pending requests expecting responses there will time out.
+func (prober *NatsProber) RemoveResponseSubject(subject string) error {
+	if err := prober.responseSubs.remove(subject); err != nil {
+		return err
+	}
+	return prober.updateInboxCoverage()
+}
+
+// updateInboxCoverage makes AutoResponseSubjects subscriptions not overlap with response subjects.
+func (prober *NatsProber) updateInboxCoverage() error {
+	if prober.inboxes == nil {
+		return nil
+	}
+	return prober.inboxes.updateCoverage()
+}
+
+// Subjects returns currently subscribed request and response subjects,
+// not including ones subscribed by AutoResponseSubjects.
+func (prober *NatsProber) Subjects() (requestSubjects []string, responseSubjects []string) {
+	return prober.requestSubs.subjects(), prober.responseSubs.subjects()
+}
@@ -0,0 +1,205 @@
+package natsprober
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+// SyntheticProbe describes requests the prober publishes itself, Rate times per second
+// with intervals randomly shifted by up to Jitter. Payload and header values are
+// text/template templates executed with SyntheticTemplateData.
+type SyntheticProbe struct {
+	Subject string
+	Payload string
+	Headers map[string]string
+	Rate    float64
+	Jitter  time.Duration
+}
+
+// SyntheticTemplateData is passed to templates of SyntheticProbe.
+type SyntheticTemplateData struct {
+	Subject string
+	// Seq is the number of request within the probe, starting from 1
+	Seq  uint64
+	Time time.Time
+}
+
+// syntheticInboxPrefix is shared by inboxes of all probers, so that synthetic requests
+// of other instances (e.g. of the same cluster) aren't taken for organic traffic.
+const syntheticInboxPrefix = "_INBOX.prober_synthetic"
+
+// synthetic publishes requests of SyntheticProbes with reply subjects under its own inbox.
+// Their responses are received by its own subscription, bypassing passive ones.
+type synthetic struct {
+	prober *NatsProber
+	inbox  string
+	sub    *nats.Subscription
+	// Last token of reply subjects, updated atomically
+	lastToken uint64
+
+	stopChan chan bool
+	wg       sync.WaitGroup
+}
+
+type syntheticSender struct {
+	probe   *SyntheticProbe
+	payload *template.Template
+	headers map[string]*template.Template
+	seq     uint64
+}
+
+func startSynthetic(prober *NatsProber) (*synthetic, error) {
+	senders := make([]*syntheticSender, len(prober.SyntheticProbes))
+	for i := range prober.SyntheticProbes {
+		sender, err := newSyntheticSender(&prober.SyntheticProbes[i])
+		if err != nil {
+			return nil, err
+		}
+		senders[i] = sender
+	}
+
+	s := &synthetic{
+		prober:   prober,
+		inbox:    syntheticInboxPrefix + "." + nuid.Next(),
+		stopChan: make(chan bool),
+	}
+	var err error
+	if s.sub, err = prober.natsConn.Subscribe(s.inbox+".*", s.handleResponse); err != nil {
+		return nil, err
+	}
+
+	for _, sender := range senders {
+		s.wg.Add(1)
+		go s.run(sender)
+	}
+	return s, nil
+}
+
+func newSyntheticSender(probe *SyntheticProbe) (*syntheticSender, error) {
+	if len(probe.Subject) == 0 {
+		return nil, fmt.Errorf("synthetic probe subject is not set")
+	}
+	if probe.Rate <= 0 {
+		return nil, fmt.Errorf("synthetic probe '%s' rate must be positive", probe.Subject)
+	}
+	payload, err := template.New("payload").Parse(probe.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("synthetic probe '%s' payload: %v", probe.Subject, err)
+	}
+	headers := make(map[string]*template.Template, len(probe.Headers))
+	for name, value := range probe.Headers {
+		if headers[name], err = template.New(name).Parse(value); err != nil {
+			return nil, fmt.Errorf("synthetic probe '%s' header '%s': %v", probe.Subject, name, err)
+		}
+	}
+	return &syntheticSender{
+		probe:   probe,
+		payload: payload,
+		headers: headers,
+	}, nil
+}
+
+// stop stops publishing requests, already pending ones still get their responses until unsubscribe.
+func (s *synthetic) stop() {
+	close(s.stopChan)
+	s.wg.Wait()
+}
+
+func (s *synthetic) unsubscribe() error {
+	return s.sub.Unsubscribe()
+}
+
+func (s *synthetic) run(sender *syntheticSender) {
+	defer s.wg.Done()
+
+	interval := time.Duration(float64(time.Second) / sender.probe.Rate)
+	timer := time.NewTimer(jitter(interval, sender.probe.Jitter))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+		case <-s.stopChan:
+			return
+		}
+		if err := s.send(sender); err != nil {
+			log.Printf("NatsProber: can't send synthetic request to '%s': %v", sender.probe.Subject, err)
+		}
+		timer.Reset(jitter(interval, sender.probe.Jitter))
+	}
+}
+
+func jitter(interval time.Duration, jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return interval
+	}
+	if interval += time.Duration(rand.Int63n(int64(jitter)*2+1)) - jitter; interval < 0 {
+		return 0
+	}
+	return interval
+}
+
+func (s *synthetic) send(sender *syntheticSender) error {
+	sender.seq++
+	data := &SyntheticTemplateData{
+		Subject: sender.probe.Subject,
+		Seq:     sender.seq,
+		Time:    time.Now(),
+	}
+
+	var payload bytes.Buffer
+	if err := sender.payload.Execute(&payload, data); err != nil {
+		return err
+	}
+	msg := &nats.Msg{
+		Subject: sender.probe.Subject,
+		Reply:   s.inbox + "." + strconv.FormatUint(atomic.AddUint64(&s.lastToken, 1), 36),
+		Data:    payload.Bytes(),
+	}
+	if len(sender.headers) > 0 {
+		msg.Header = make(nats.Header, len(sender.headers))
+		for name, value := range sender.headers {
+			var b strings.Builder
+			if err := value.Execute(&b, data); err != nil {
+				return err
+			}
+			msg.Header.Set(name, b.String())
+		}
+	}
+
+	// Enqueue first, so that a fast response can't overtake the request
+	request := newNatsMessage(msg, msg.Reply)
+	request.Synthetic = true
+	s.prober.enqueueRequest(request)
+	if err := s.prober.natsConn.PublishMsg(msg); err != nil {
+		// Nothing will respond to it, so don't let it be reported as timeouted
+		s.prober.dropRequest(request, DropReasonPublishFailed)
+		return err
+	}
+	return nil
+}
+
+func (s *synthetic) handleResponse(msg *nats.Msg) {
+	s.prober.handlersWg.Add(1)
+	defer s.prober.handlersWg.Done()
+	response := newNatsMessage(msg, msg.Subject)
+	response.Synthetic = true
+	s.prober.enqueueResponse(response)
+}
+
+// isSyntheticReply reports whether subject is under synthetic inbox of any prober,
+// such messages are ignored by passive subscriptions.
+func isSyntheticReply(subject string) bool {
+	return strings.HasPrefix(subject, syntheticInboxPrefix+".")
+}
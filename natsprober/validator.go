@@ -0,0 +1,100 @@
+package natsprober
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// Validator checks response matched to request, returning the reason if it's invalid.
+type Validator interface {
+	Validate(request *NatsMessage, response *NatsMessage) error
+}
+
+// ValidatorFunc adapts a function to Validator.
+type ValidatorFunc func(request *NatsMessage, response *NatsMessage) error
+
+func (f ValidatorFunc) Validate(request *NatsMessage, response *NatsMessage) error {
+	return f(request, response)
+}
+
+// SubjectValidator applies Validator to responses to requests with subjects matching
+// Subject pattern (with "*" and ">" wildcards).
+type SubjectValidator struct {
+	Subject   string
+	Validator Validator
+}
+
+// validate applies all validators matching request subject in order, returning the first failure.
+func (prober *NatsProber) validate(request *NatsMessage, response *NatsMessage) error {
+	for i := range prober.Validators {
+		if !matchSubject(prober.Validators[i].Subject, request.Msg.Subject) {
+			continue
+		}
+		if err := prober.Validators[i].Validator.Validate(request, response); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StatusHeaderValidator checks status header of responses, "Status" if Header is not set.
+// NATS status messages never reach validators, see SetNoRespondersHandler. Responses
+// without the header are valid. If Allowed is empty, numeric statuses below 400 are valid,
+// otherwise only listed ones are.
+type StatusHeaderValidator struct {
+	Header  string
+	Allowed []string
+}
+
+func (v StatusHeaderValidator) Validate(_ *NatsMessage, response *NatsMessage) error {
+	header := v.Header
+	if len(header) == 0 {
+		header = "Status"
+	}
+	status := response.Msg.Header.Get(header)
+	if len(status) == 0 {
+		return nil
+	}
+	if len(v.Allowed) == 0 {
+		if code, err := strconv.Atoi(status); err == nil && code < 400 {
+			return nil
+		}
+		return fmt.Errorf("status header %s: %s", header, status)
+	}
+	for _, allowed := range v.Allowed {
+		if status == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("status header %s: %s is not allowed", header, status)
+}
+
+// MaxSizeValidator fails responses with data larger than MaxBytes.
+type MaxSizeValidator struct {
+	MaxBytes int
+}
+
+func (v MaxSizeValidator) Validate(_ *NatsMessage, response *NatsMessage) error {
+	if size := len(response.Msg.Data); size > v.MaxBytes {
+		return fmt.Errorf("size %d exceeds %d bytes", size, v.MaxBytes)
+	}
+	return nil
+}
+
+// RegexValidator requires response data to match Regexp, or not to match it with MustNotMatch
+// (e.g. to catch error envelopes).
+type RegexValidator struct {
+	Regexp       *regexp.Regexp
+	MustNotMatch bool
+}
+
+func (v RegexValidator) Validate(_ *NatsMessage, response *NatsMessage) error {
+	if matched := v.Regexp.Match(response.Msg.Data); matched == v.MustNotMatch {
+		if v.MustNotMatch {
+			return fmt.Errorf("matches /%s/", v.Regexp)
+		}
+		return fmt.Errorf("doesn't match /%s/", v.Regexp)
+	}
+	return nil
+}
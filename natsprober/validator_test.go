@@ -0,0 +1,143 @@
+package natsprober
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func testResponseData(data string, header nats.Header) *NatsMessage {
+	return &NatsMessage{Msg: &nats.Msg{Subject: "reply", Data: []byte(data), Header: header}}
+}
+
+func TestJSONSchemaValidator(t *testing.T) {
+	validator, err := NewJSONSchemaValidator([]byte(`{
+		"type": "object",
+		"required": ["id", "items"],
+		"additionalProperties": false,
+		"properties": {
+			"id": {"type": "integer", "minimum": 1},
+			"status": {"enum": ["ok", "partial"]},
+			"name": {"type": ["string", "null"], "maxLength": 5, "pattern": "^[a-z]*$"},
+			"items": {"type": "array", "items": {"type": "number", "maximum": 10}}
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("Can't parse schema: %v", err)
+	}
+
+	for data, reason := range map[string]string{
+		`{"id": 1, "items": [1.5, 2], "status": "ok", "name": null}`: "",
+		`{"id": 1, "items": [], "name": "abc"}`:                      "",
+		`{"id": 1`:                                                   "malformed JSON",
+		`[]`:                                                         "$: array is not of type [object]",
+		`{"items": []}`:                                              "required property 'id'",
+		`{"id": 1.5, "items": []}`:                                   "$.id: number is not of type [integer]",
+		`{"id": 0, "items": []}`:                                     "$.id: 0 is less than 1",
+		`{"id": 1, "items": [1, 11]}`:                                "$.items[1]: 11 is greater than 10",
+		`{"id": 1, "items": [], "status": "failed"}`:                 "$.status: value is not one of enum",
+		`{"id": 1, "items": [], "name": "abcdef"}`:                   "$.name: string is longer than 5",
+		`{"id": 1, "items": [], "name": "ABC"}`:                      "$.name: string doesn't match",
+		`{"id": 1, "items": [], "error": "oops"}`:                    "additional property 'error'",
+	} {
+		err := validator.Validate(nil, testResponseData(data, nil))
+		if len(reason) == 0 && err != nil {
+			t.Errorf("%s: unexpected failure %v", data, err)
+		}
+		if len(reason) > 0 && (err == nil || !strings.Contains(err.Error(), reason)) {
+			t.Errorf("%s: wrong failure %v, expected %s", data, err, reason)
+		}
+	}
+
+	if _, err := NewJSONSchemaValidator([]byte(`{"type": 1}`)); err == nil {
+		t.Errorf("Schema with wrong type accepted")
+	}
+	for _, schema := range []string{
+		`{"oneOf": [{"type": "string"}]}`,
+		`{"properties": {"id": {"const": 1}}}`,
+		`{"items": {"$ref": "#/definitions/item"}}`,
+		`{"pattern": "^(?=a)"}`,
+	} {
+		if _, err := NewJSONSchemaValidator([]byte(schema)); err == nil {
+			t.Errorf("Unsupported schema %s accepted", schema)
+		}
+	}
+	if _, err := NewJSONSchemaValidator([]byte(`{"$schema": "http://json-schema.org/draft-07/schema#", "title": "a", "type": "object"}`)); err != nil {
+		t.Errorf("Schema with annotations rejected: %v", err)
+	}
+}
+
+func TestValidators(t *testing.T) {
+	status := StatusHeaderValidator{}
+	if err := status.Validate(nil, testResponseData("", nats.Header{"Status": []string{"503"}})); err == nil {
+		t.Errorf("No responders status accepted")
+	}
+	if err := status.Validate(nil, testResponseData("", nats.Header{"Status": []string{"200"}})); err != nil {
+		t.Errorf("Successful status rejected: %v", err)
+	}
+	allowed := StatusHeaderValidator{Header: "App-Status", Allowed: []string{"ok"}}
+	if err := allowed.Validate(nil, testResponseData("", nats.Header{"App-Status": []string{"error"}})); err == nil {
+		t.Errorf("Not allowed status accepted")
+	}
+
+	if err := (MaxSizeValidator{MaxBytes: 3}).Validate(nil, testResponseData("abcd", nil)); err == nil {
+		t.Errorf("Oversized response accepted")
+	}
+
+	envelope := RegexValidator{Regexp: regexp.MustCompile(`"error"\s*:`), MustNotMatch: true}
+	if err := envelope.Validate(nil, testResponseData(`{"error": "failed"}`, nil)); err == nil {
+		t.Errorf("Error envelope accepted")
+	}
+	if err := envelope.Validate(nil, testResponseData(`{"result": 1}`, nil)); err != nil {
+		t.Errorf("Valid response rejected: %v", err)
+	}
+}
+
+func TestWorkerInvalidResponses(t *testing.T) {
+	prober := &NatsProber{
+		RequestTimeoutSeconds:    10,
+		WorkerMaxPendingRequests: 10,
+		Validators: []SubjectValidator{
+			{Subject: "svc.*", Validator: MaxSizeValidator{MaxBytes: 2}},
+			{Subject: "svc.strict", Validator: ValidatorFunc(func(_ *NatsMessage, response *NatsMessage) error {
+				if len(response.Msg.Data) == 0 {
+					return errEmptyResponse
+				}
+				return nil
+			})},
+		},
+	}
+	var successful int
+	var reasons []error
+	prober.SetSuccessfulResponseHandler(func(*NatsMessage, *NatsMessage) { successful++ })
+	prober.SetInvalidResponseHandler(func(_ *NatsMessage, _ *NatsMessage, reason error) {
+		reasons = append(reasons, reason)
+	})
+	w := newTestWorker(prober)
+
+	now := time.Now()
+	w.handleRequest(testSubjectRequest("svc.loose", "a", now))
+	w.handleRequest(testSubjectRequest("svc.strict", "b", now))
+	w.handleRequest(testSubjectRequest("svc.strict", "c", now))
+	w.handleRequest(testSubjectRequest("other", "d", now))
+	w.handleResponse(&NatsMessage{Msg: &nats.Msg{Subject: "a"}, Key: "a", ReceivedAt: now})
+	w.handleResponse(&NatsMessage{Msg: &nats.Msg{Subject: "b"}, Key: "b", ReceivedAt: now})
+	w.handleResponse(&NatsMessage{Msg: &nats.Msg{Subject: "c", Data: []byte("abc")}, Key: "c", ReceivedAt: now})
+	w.handleResponse(&NatsMessage{Msg: &nats.Msg{Subject: "d", Data: []byte("abc")}, Key: "d", ReceivedAt: now})
+
+	if successful != 2 {
+		t.Errorf("Wrong successful count %d", successful)
+	}
+	if len(reasons) != 2 || reasons[0] != errEmptyResponse || !strings.Contains(reasons[1].Error(), "exceeds") {
+		t.Errorf("Wrong invalid reasons %v", reasons)
+	}
+	if w.pendingRequests.Len() != 0 {
+		t.Errorf("Invalid responses must resolve requests")
+	}
+}
+
+var errEmptyResponse = errors.New("empty response")
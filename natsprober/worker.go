@@ -1,55 +1,218 @@
 package natsprober
 
 import (
+	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aurora-is-near/nats-prober/linkedmap"
 )
 
+const defaultWorkerQueueSize = 100
+
+type pendingRequest struct {
+	request   *NatsMessage
+	policy    int
+	deadline  time.Time
+	heapIndex int
+	// Bytes accounted for the request and queued ones, see NatsMessage.memorySize
+	size int64
+	// Later requests with the same key waiting for their turn, see MaxDuplicateRequests
+	queued []*NatsMessage
+
+	// Only used when gathering multiple responses
+	responses       uint
+	firstResponseAt time.Time
+	lastResponseAt  time.Time
+}
+
 type worker struct {
 	prober *NatsProber
+	id     uint64
 
 	requests  chan *NatsMessage
 	responses chan *NatsMessage
+	commands  chan func()
 	stopChan  chan bool
 	wg        sync.WaitGroup
 
-	pendingRequests *linkedmap.LinkedMap[string, *NatsMessage]
+	// All pending requests in arrival order
+	pendingRequests *linkedmap.LinkedMap[string, *pendingRequest]
+	// Pending requests by policy index in arrival order, for per-policy limits
+	policyQueues []*linkedmap.LinkedMap[string, *pendingRequest]
+	// Requests queued behind pending ones, in total and by policy index of pending ones,
+	// counted against pending requests limits along with pending ones
+	queuedCount  int
+	policyQueued []int
+	// Pending requests ordered by deadline
+	deadlines deadlineHeap
+	// Deadline the timeouts timer is currently set for
+	scheduledDeadline time.Time
+	// Mirrors pendingRequests.Len() for lock-free reads from other goroutines
+	pendingCount int64
+	// Bytes of pending requests and orphan responses, only changed by worker goroutine
+	// but updated atomically for reads from other goroutines
+	pendingBytes int64
+	// Unmatched responses held for OrphanResponseGrace in arrival order, and their bytes
+	orphanResponses *linkedmap.LinkedMap[string, *NatsMessage]
+	orphanBytes     int64
 }
 
-func startWorker(prober *NatsProber) *worker {
-	w := &worker{
+func newWorker(prober *NatsProber, id uint64) *worker {
+	queueSize := prober.WorkerQueueSize
+	if queueSize == 0 {
+		queueSize = defaultWorkerQueueSize
+	}
+	return &worker{
 		prober:          prober,
-		requests:        make(chan *NatsMessage, 100),
-		responses:       make(chan *NatsMessage, 100),
+		id:              id,
+		commands:        make(chan func()),
+		requests:        make(chan *NatsMessage, queueSize),
+		responses:       make(chan *NatsMessage, queueSize),
 		stopChan:        make(chan bool),
-		pendingRequests: linkedmap.New[string, *NatsMessage](),
+		pendingRequests: linkedmap.New[string, *pendingRequest](),
+		policyQueues:    newPolicyQueues(prober),
+		policyQueued:    make([]int, len(prober.Policies)+1),
+		orphanResponses: linkedmap.New[string, *NatsMessage](),
 	}
+}
 
+func startWorker(prober *NatsProber, id uint64) *worker {
+	w := newWorker(prober, id)
 	w.wg.Add(1)
 	go w.run()
 	return w
 }
 
+func newPolicyQueues(prober *NatsProber) []*linkedmap.LinkedMap[string, *pendingRequest] {
+	queues := make([]*linkedmap.LinkedMap[string, *pendingRequest], len(prober.Policies)+1)
+	for i := range queues {
+		queues[i] = linkedmap.New[string, *pendingRequest]()
+	}
+	return queues
+}
+
 func (w *worker) stop() {
 	w.stopChan <- true
 	w.wg.Wait()
 }
 
+// execute runs command on worker goroutine and waits for it to finish.
+func (w *worker) execute(command func()) {
+	done := make(chan bool)
+	w.commands <- func() {
+		command()
+		close(done)
+	}
+	<-done
+}
+
+// drainQueues handles all messages queued so far.
+func (w *worker) drainQueues() {
+	for {
+		select {
+		case request := <-w.requests:
+			w.handleRequest(request)
+		case response := <-w.responses:
+			w.handleResponse(response)
+		default:
+			return
+		}
+	}
+}
+
+// extract handles queued messages and then removes and returns pending requests
+// for which move returns true, in arrival order.
+func (w *worker) extract(move func(key string) bool) []*pendingRequest {
+	var moved []*pendingRequest
+	w.execute(func() {
+		w.drainQueues()
+		w.pendingRequests.ForEach(func(key string, pending *pendingRequest) bool {
+			if move(key) {
+				moved = append(moved, pending)
+			}
+			return true
+		})
+		for _, pending := range moved {
+			w.remove(pending)
+		}
+	})
+	return moved
+}
+
+// drop handles queued messages and then removes pending request of key, if it's still
+// pending, reporting it and requests queued behind it as dropped for reason.
+func (w *worker) drop(key string, reason DropReason) {
+	w.execute(func() {
+		w.drainQueues()
+		if pending, ok := w.pendingRequests.Get(key); ok {
+			w.remove(pending)
+			w.prober.reportDropped(pending.request, reason)
+			w.dropQueued(pending, reason)
+		}
+	})
+}
+
+// extractOrphans removes and returns orphan responses for which move returns true, in arrival order.
+func (w *worker) extractOrphans(move func(key string) bool) []*NatsMessage {
+	var moved []*NatsMessage
+	w.execute(func() {
+		w.orphanResponses.ForEach(func(key string, orphan *NatsMessage) bool {
+			if move(key) {
+				moved = append(moved, orphan)
+			}
+			return true
+		})
+		for _, orphan := range moved {
+			w.popOrphanResponse(orphan.Key)
+		}
+	})
+	return moved
+}
+
+// adopt adds requests and then orphan responses extracted from another worker,
+// keeping their deadlines and receive times.
+func (w *worker) adopt(entries []*pendingRequest, orphans []*NatsMessage) {
+	w.execute(func() {
+		for _, pending := range entries {
+			w.insert(pending)
+		}
+		for _, orphan := range orphans {
+			w.handleResponse(orphan)
+		}
+	})
+}
+
 func (w *worker) addRequest(request *NatsMessage) {
-	w.requests <- request
+	if !w.prober.NonBlockingEnqueue {
+		w.requests <- request
+		return
+	}
+	select {
+	case w.requests <- request:
+	default:
+		w.prober.reportDropped(request, DropReasonRequestQueueOverflow)
+	}
 }
 
 func (w *worker) addResponse(response *NatsMessage) {
-	w.responses <- response
+	if !w.prober.NonBlockingEnqueue {
+		w.responses <- response
+		return
+	}
+	select {
+	case w.responses <- response:
+	default:
+		w.prober.reportDroppedResponse(response, DropReasonResponseQueueOverflow)
+	}
 }
 
 func (w *worker) run() {
 	defer w.wg.Done()
 
-	timeoutsCheckTicker := time.NewTicker(time.Second / 10)
-	defer timeoutsCheckTicker.Stop()
+	timeoutsTimer := time.NewTimer(time.Hour)
+	timeoutsTimer.Stop()
 
 	for {
 		// Prioritized stop-check
@@ -61,7 +224,8 @@ func (w *worker) run() {
 
 		// Prioritized timeouts-check
 		select {
-		case <-timeoutsCheckTicker.C:
+		case <-timeoutsTimer.C:
+			w.scheduledDeadline = time.Time{}
 			w.checkTimeouts()
 		default:
 		}
@@ -71,50 +235,432 @@ func (w *worker) run() {
 			w.handleRequest(request)
 		case response := <-w.responses:
 			w.handleResponse(response)
-		case <-timeoutsCheckTicker.C:
+		case <-timeoutsTimer.C:
+			w.scheduledDeadline = time.Time{}
 			w.checkTimeouts()
+		case command := <-w.commands:
+			command()
 		case <-w.stopChan:
 			return
 		}
+
+		w.scheduleTimeouts(timeoutsTimer)
+		atomic.StoreInt64(&w.pendingCount, int64(w.pendingRequests.Len()))
+	}
+}
+
+// scheduleTimeouts makes timer fire at the earliest pending deadline or orphan response expiry.
+func (w *worker) scheduleTimeouts(timer *time.Timer) {
+	deadline, ok := w.nextDeadline()
+	if !ok || deadline.Equal(w.scheduledDeadline) {
+		return
+	}
+	if !w.scheduledDeadline.IsZero() && !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
 	}
+	w.scheduledDeadline = deadline
+	timer.Reset(time.Until(deadline))
+}
+
+func (w *worker) nextDeadline() (time.Time, bool) {
+	var deadline time.Time
+	if earliest, ok := w.deadlines.first(); ok {
+		deadline = earliest.deadline
+	}
+	if orphan, ok := w.orphanResponses.GetFirst(); ok {
+		if expiry := orphan.ReceivedAt.Add(w.prober.orphanResponseGrace()); deadline.IsZero() || expiry.Before(deadline) {
+			deadline = expiry
+		}
+	}
+	return deadline, !deadline.IsZero()
 }
 
 func (w *worker) checkTimeouts() {
+	now := time.Now()
+	w.expireOrphanResponses(now)
 	for {
+		earliest, ok := w.deadlines.first()
+		if !ok || now.Before(earliest.deadline) {
+			return
+		}
+		w.resolve(earliest)
+		if earliest.responses > 0 {
+			w.prober.reportGatherCompleted(earliest.request, earliest.gatherResult())
+		} else {
+			w.prober.reportTimeouted(earliest.request)
+		}
+	}
+}
+
+func (w *worker) newPendingRequest(request *NatsMessage) *pendingRequest {
+	policy := w.prober.policyIndex(request.Msg.Subject)
+	return &pendingRequest{
+		request:  request,
+		policy:   policy,
+		deadline: request.ReceivedAt.Add(w.prober.requestTimeout(policy)),
+		size:     request.memorySize(),
+	}
+}
+
+func (w *worker) handleRequest(request *NatsMessage) {
+	if current, ok := w.pendingRequests.Get(request.Key); ok {
+		w.handleDuplicateRequest(current, request)
+		return
+	}
+
+	pending := w.newPendingRequest(request)
+	if !w.admit(pending) {
+		return
+	}
+
+	w.insert(pending)
+
+	if orphan, ok := w.popOrphanResponse(request.Key); ok {
+		w.handleResponse(orphan)
+	}
+}
+
+// admit applies pending requests limits and byte budgets to a new request, making room for it
+// or dropping it according to drop policies, and returns whether it may be added.
+func (w *worker) admit(pending *pendingRequest) bool {
+	policy := pending.policy
+	if policy < len(w.prober.Policies) {
+		subjectPolicy := &w.prober.Policies[policy]
+		queue := w.policyQueues[policy]
+		if subjectPolicy.MaxPending > 0 && queue.Len()+w.policyQueued[policy] >= int(subjectPolicy.MaxPending) {
+			if !w.makeRoom(queue, subjectPolicy.DropPolicy, subjectPolicy.SampleRate, pending) {
+				return false
+			}
+		}
+	}
+	if limit := w.prober.WorkerMaxPendingRequests; limit > 0 && w.pendingRequests.Len()+w.queuedCount >= int(limit) {
+		if !w.makeRoom(w.pendingRequests, w.prober.DropPolicy, w.prober.DropSampleRate, pending) {
+			return false
+		}
+	}
+	if w.exceedsByteBudget(pending.size) && !w.makeRoomForBytes(pending) {
+		return false
+	}
+	return true
+}
+
+// exceedsByteBudget reports whether adding size bytes would exceed WorkerMaxPendingBytes or MaxPendingBytes.
+func (w *worker) exceedsByteBudget(size int64) bool {
+	if limit := w.prober.WorkerMaxPendingBytes; limit > 0 && atomic.LoadInt64(&w.pendingBytes)+size > int64(limit) {
+		return true
+	}
+	if limit := w.prober.MaxPendingBytes; limit > 0 && atomic.LoadInt64(&w.prober.pendingBytes)+size > int64(limit) {
+		return true
+	}
+	return false
+}
+
+// fitsByteBudget reports whether size bytes would fit into byte budgets once all pending
+// requests of the worker are evicted. Orphan responses and other workers' requests stay.
+func (w *worker) fitsByteBudget(size int64) bool {
+	if limit := w.prober.WorkerMaxPendingBytes; limit > 0 && w.orphanBytes+size > int64(limit) {
+		return false
+	}
+	if limit := w.prober.MaxPendingBytes; limit > 0 {
+		evictable := atomic.LoadInt64(&w.pendingBytes) - w.orphanBytes
+		if atomic.LoadInt64(&w.prober.pendingBytes)-evictable+size > int64(limit) {
+			return false
+		}
+	}
+	return true
+}
+
+// makeRoomForBytes evicts the oldest pending requests of the worker until the new one fits
+// into byte budgets, or drops the new one according to drop policy, returning whether
+// the new one may be added. Requests of other workers are never evicted, so that
+// the worker doesn't wait for others when the global budget is exhausted. A request that
+// wouldn't fit even after evicting all of the worker's ones is dropped without evictions.
+func (w *worker) makeRoomForBytes(pending *pendingRequest) bool {
+	switch w.prober.DropPolicy {
+	case DropNewest:
+		w.prober.reportDropped(pending.request, DropReasonMemory)
+		return false
+	case RejectNew:
+		w.prober.reportRejected(pending.request)
+		return false
+	}
+	if !w.fitsByteBudget(pending.size) {
+		w.prober.reportDropped(pending.request, DropReasonMemory)
+		return false
+	}
+	if w.prober.DropPolicy == DropSample && rand.Float64() >= w.prober.DropSampleRate {
+		w.prober.reportDropped(pending.request, DropReasonSampledOut)
+		return false
+	}
+
+	for w.exceedsByteBudget(pending.size) {
 		oldest, ok := w.pendingRequests.GetFirst()
 		if !ok {
-			return
+			w.prober.reportDropped(pending.request, DropReasonMemory)
+			return false
 		}
-		if time.Since(oldest.ReceivedAt) < time.Duration(w.prober.RequestTimeoutSeconds)*time.Second {
+		w.remove(oldest)
+		w.prober.reportDropped(oldest.request, DropReasonMemory)
+		w.dropQueued(oldest, DropReasonMemory)
+	}
+	return true
+}
+
+// handleDuplicateRequest handles request reusing key of a pending one (e.g. a client reusing
+// its reply subject). It's queued behind the pending one if MaxDuplicateRequests allows,
+// otherwise the earliest request of the key is superseded by it. Queued requests are subject
+// to the same limits as new ones, counted against the policy of the pending one.
+func (w *worker) handleDuplicateRequest(current *pendingRequest, request *NatsMessage) {
+	if uint(len(current.queued)) >= w.prober.MaxDuplicateRequests {
+		w.remove(current)
+		w.prober.reportSuperseded(current.request, request)
+		next, ok := w.promote(current)
+		if !ok {
+			w.handleRequest(request)
 			return
 		}
-		w.pendingRequests.PopFirst()
+		current = next
+	}
 
-		if w.prober.timeoutedRequestHandler != nil {
-			w.prober.timeoutedRequestHandler(oldest)
-		}
+	queued := &pendingRequest{
+		request: request,
+		policy:  current.policy,
+		size:    request.memorySize(),
+	}
+	if !w.admit(queued) {
+		return
 	}
+	// Making room may have evicted the pending request along with ones queued behind it
+	if current, ok := w.pendingRequests.Get(request.Key); ok {
+		current.queued = append(current.queued, request)
+		current.size += queued.size
+		w.addQueued(current.policy, 1)
+		w.addPendingBytes(queued.size)
+		return
+	}
+	w.insert(w.newPendingRequest(request))
 }
 
-func (w *worker) handleRequest(request *NatsMessage) {
-	if w.pendingRequests.Len() == int(w.prober.WorkerMaxPendingRequests) {
-		droppedRequest, _ := w.pendingRequests.PopFirst()
-		if w.prober.droppedRequestHandler != nil {
-			w.prober.droppedRequestHandler(droppedRequest)
+// promote makes the first request queued behind removed pending one pending in its place.
+func (w *worker) promote(removed *pendingRequest) (*pendingRequest, bool) {
+	if len(removed.queued) == 0 {
+		return nil, false
+	}
+	next := w.newPendingRequest(removed.queued[0])
+	for _, queued := range removed.queued[1:] {
+		next.queued = append(next.queued, queued)
+		next.size += queued.memorySize()
+	}
+	w.insert(next)
+	return next, true
+}
+
+// resolve removes pending request whose outcome is reported, promoting the next queued one.
+func (w *worker) resolve(pending *pendingRequest) {
+	w.remove(pending)
+	w.promote(pending)
+}
+
+// dropQueued reports requests queued behind removed pending one as dropped with it.
+func (w *worker) dropQueued(removed *pendingRequest, reason DropReason) {
+	for _, queued := range removed.queued {
+		w.prober.reportDropped(queued, reason)
+	}
+}
+
+func (w *worker) insert(pending *pendingRequest) {
+	key := pending.request.Key
+	w.pendingRequests.PushLast(key, pending)
+	w.policyQueues[pending.policy].PushLast(key, pending)
+	w.deadlines.add(pending)
+	w.addQueued(pending.policy, len(pending.queued))
+	w.addPendingBytes(pending.size)
+}
+
+func (w *worker) addQueued(policy int, count int) {
+	w.queuedCount += count
+	w.policyQueued[policy] += count
+}
+
+func (w *worker) addPendingBytes(size int64) {
+	atomic.AddInt64(&w.pendingBytes, size)
+	atomic.AddInt64(&w.prober.pendingBytes, size)
+}
+
+// makeRoom drops either the oldest request of the queue or the new one according to drop policy,
+// returning whether the new one may be added.
+func (w *worker) makeRoom(queue *linkedmap.LinkedMap[string, *pendingRequest], dropPolicy DropPolicy, sampleRate float64, pending *pendingRequest) bool {
+	oldest, ok := queue.GetFirst()
+	if !ok {
+		w.prober.reportDropped(pending.request, DropReasonCapacity)
+		return false
+	}
+
+	switch dropPolicy {
+	case DropNewest:
+		w.prober.reportDropped(pending.request, DropReasonCapacity)
+		return false
+	case RejectNew:
+		w.prober.reportRejected(pending.request)
+		return false
+	case DropSample:
+		if rand.Float64() >= sampleRate {
+			w.prober.reportDropped(pending.request, DropReasonSampledOut)
+			return false
 		}
 	}
-	w.pendingRequests.PushLast(request.Msg.Reply, request)
+
+	w.remove(oldest)
+	w.prober.reportDropped(oldest.request, DropReasonCapacity)
+	w.dropQueued(oldest, DropReasonCapacity)
+	return true
+}
+
+func (w *worker) remove(pending *pendingRequest) {
+	w.pendingRequests.Pop(pending.request.Key)
+	w.policyQueues[pending.policy].Pop(pending.request.Key)
+	w.deadlines.remove(pending)
+	w.addQueued(pending.policy, -len(pending.queued))
+	w.addPendingBytes(-pending.size)
 }
 
 func (w *worker) handleResponse(response *NatsMessage) {
-	request, ok := w.pendingRequests.Pop(response.Msg.Subject)
+	if len(response.Key) == 0 {
+		w.prober.reportUnknown(response)
+		return
+	}
+
+	pending, ok := w.pendingRequests.Get(response.Key)
 	if !ok {
-		if w.prober.unknownResponseHandler != nil {
-			w.prober.unknownResponseHandler(response)
+		w.handleUnmatchedResponse(response)
+		return
+	}
+
+	if status := natsStatus(response.Msg); status != 0 {
+		w.resolve(pending)
+		if pending.responses > 0 {
+			w.prober.reportGatherCompleted(pending.request, pending.gatherResult())
+		} else {
+			w.prober.reportNoResponders(pending.request, response, status)
 		}
 		return
 	}
-	if w.prober.successfulResponseHandler != nil {
-		w.prober.successfulResponseHandler(request, response)
+
+	if !w.prober.GatherResponses {
+		w.resolve(pending)
+		if err := w.prober.validate(pending.request, response); err != nil {
+			w.prober.reportInvalid(pending.request, response, err, true)
+			return
+		}
+		w.prober.reportSuccessful(pending.request, response)
+		return
+	}
+
+	if err := w.prober.validate(pending.request, response); err != nil {
+		w.prober.reportInvalid(pending.request, response, err, false)
+		return
+	}
+	pending.responses++
+	if pending.responses == 1 {
+		pending.firstResponseAt = response.ReceivedAt
+	}
+	pending.lastResponseAt = response.ReceivedAt
+	w.prober.reportGatheredResponse(pending.request, response, pending.responses)
+
+	if pending.responses == w.prober.GatherMaxResponses {
+		w.resolve(pending)
+		w.prober.reportGatherCompleted(pending.request, pending.gatherResult())
+	}
+}
+
+// handleUnmatchedResponse reports response as unknown, or holds it for OrphanResponseGrace
+// in case its request arrives later. Only the latest response per key is held, and only
+// while it fits into byte budgets.
+func (w *worker) handleUnmatchedResponse(response *NatsMessage) {
+	if w.prober.orphanResponseGrace() <= 0 {
+		w.prober.reportUnknown(response)
+		return
+	}
+	if previous, ok := w.popOrphanResponse(response.Key); ok {
+		w.prober.reportUnknown(previous)
+	}
+	if limit := w.prober.WorkerMaxPendingRequests; limit > 0 && w.orphanResponses.Len() >= int(limit) {
+		if oldest, ok := w.orphanResponses.GetFirst(); ok {
+			w.popOrphanResponse(oldest.Key)
+			w.prober.reportUnknown(oldest)
+		}
+	}
+	if w.exceedsByteBudget(response.memorySize()) {
+		w.prober.reportUnknown(response)
+		return
+	}
+	w.orphanResponses.PushLast(response.Key, response)
+	w.orphanBytes += response.memorySize()
+	w.addPendingBytes(response.memorySize())
+}
+
+func (w *worker) popOrphanResponse(key string) (*NatsMessage, bool) {
+	orphan, ok := w.orphanResponses.Pop(key)
+	if ok {
+		w.orphanBytes -= orphan.memorySize()
+		w.addPendingBytes(-orphan.memorySize())
+	}
+	return orphan, ok
+}
+
+func (w *worker) expireOrphanResponses(now time.Time) {
+	grace := w.prober.orphanResponseGrace()
+	for {
+		orphan, ok := w.orphanResponses.GetFirst()
+		if !ok || now.Before(orphan.ReceivedAt.Add(grace)) {
+			return
+		}
+		w.popOrphanResponse(orphan.Key)
+		w.prober.reportUnknown(orphan)
+	}
+}
+
+// abandon reports all pending requests as abandoned (or gather completed, if they got responses)
+// and orphan responses as unknown, on shutdown.
+func (w *worker) abandon() {
+	w.drainQueues()
+	for {
+		orphan, ok := w.orphanResponses.GetFirst()
+		if !ok {
+			break
+		}
+		w.popOrphanResponse(orphan.Key)
+		w.prober.reportUnknown(orphan)
+	}
+	for {
+		pending, ok := w.pendingRequests.GetFirst()
+		if !ok {
+			return
+		}
+		w.remove(pending)
+		if pending.responses > 0 {
+			w.prober.reportGatherCompleted(pending.request, pending.gatherResult())
+		} else {
+			w.prober.reportAbandoned(pending.request)
+		}
+		for _, queued := range pending.queued {
+			w.prober.reportAbandoned(queued)
+		}
+	}
+}
+
+// requests returns the pending request followed by ones queued behind it.
+func (pending *pendingRequest) requests() []*NatsMessage {
+	return append([]*NatsMessage{pending.request}, pending.queued...)
+}
+
+func (pending *pendingRequest) gatherResult() *GatherResult {
+	return &GatherResult{
+		Responses:    pending.responses,
+		FirstLatency: pending.firstResponseAt.Sub(pending.request.ReceivedAt),
+		LastLatency:  pending.lastResponseAt.Sub(pending.request.ReceivedAt),
 	}
 }
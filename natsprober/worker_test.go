@@ -0,0 +1,524 @@
+package natsprober
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func newTestWorker(prober *NatsProber) *worker {
+	return newWorker(prober, 0)
+}
+
+func testRequest(key string, receivedAt time.Time) *NatsMessage {
+	return testSubjectRequest("svc", key, receivedAt)
+}
+
+func testSubjectRequest(subject string, key string, receivedAt time.Time) *NatsMessage {
+	return &NatsMessage{
+		Msg:        &nats.Msg{Subject: subject, Reply: key},
+		ReceivedAt: receivedAt,
+		Key:        key,
+	}
+}
+
+func testResponse(key string, receivedAt time.Time) *NatsMessage {
+	return &NatsMessage{
+		Msg:        &nats.Msg{Subject: key},
+		ReceivedAt: receivedAt,
+		Key:        key,
+	}
+}
+
+func TestWorkerGatherResponses(t *testing.T) {
+	prober := &NatsProber{
+		RequestTimeoutSeconds:    10,
+		WorkerMaxPendingRequests: 10,
+		GatherResponses:          true,
+		GatherMaxResponses:       3,
+	}
+	var ordinals []uint
+	var results []*GatherResult
+	var timeouted, unknown int
+	prober.SetGatheredResponseHandler(func(_ *NatsMessage, _ *NatsMessage, ordinal uint) {
+		ordinals = append(ordinals, ordinal)
+	})
+	prober.SetGatherCompletedHandler(func(_ *NatsMessage, result *GatherResult) {
+		results = append(results, result)
+	})
+	prober.SetTimeoutedRequestHandler(func(*NatsMessage) { timeouted++ })
+	prober.SetUnknownResponseHandler(func(*NatsMessage) { unknown++ })
+	w := newTestWorker(prober)
+
+	start := time.Now().Add(-time.Second * 20)
+	w.handleRequest(testRequest("a", start))
+	w.handleRequest(testRequest("b", start))
+	w.handleRequest(testRequest("c", time.Now()))
+	for i := 1; i <= 3; i++ {
+		w.handleResponse(testResponse("a", start.Add(time.Millisecond*time.Duration(i))))
+	}
+	w.handleResponse(testResponse("a", start.Add(time.Millisecond*4)))
+	w.handleResponse(testResponse("b", start.Add(time.Millisecond*5)))
+
+	if len(ordinals) != 4 || ordinals[0] != 1 || ordinals[2] != 3 || ordinals[3] != 1 {
+		t.Errorf("Wrong ordinals %v", ordinals)
+	}
+	if unknown != 1 {
+		t.Errorf("Response after max responses must be unknown, got %d unknown", unknown)
+	}
+	if len(results) != 1 || results[0].Responses != 3 || results[0].FirstLatency != time.Millisecond || results[0].LastLatency != time.Millisecond*3 {
+		t.Fatalf("Wrong results after max responses")
+	}
+
+	w.checkTimeouts()
+	if len(results) != 2 || results[1].Responses != 1 || results[1].LastLatency != time.Millisecond*5 {
+		t.Errorf("Window expiry must complete the gather")
+	}
+	if timeouted != 0 || w.pendingRequests.Len() != 1 {
+		t.Errorf("Unexpected timeouts: %d timeouted, %d pending", timeouted, w.pendingRequests.Len())
+	}
+}
+
+func TestWorkerSubjectPolicies(t *testing.T) {
+	prober := &NatsProber{
+		RequestTimeout:           time.Second,
+		WorkerMaxPendingRequests: 10,
+		Policies: []SubjectPolicy{
+			{Subject: "fast.>", Timeout: time.Millisecond * 20},
+			{Subject: "batch.*", Timeout: time.Minute, MaxPending: 2, DropPolicy: DropNewest},
+		},
+	}
+	var timeouted, dropped []string
+	prober.SetTimeoutedRequestHandler(func(request *NatsMessage) { timeouted = append(timeouted, request.Key) })
+	prober.SetDroppedRequestHandler(func(request *NatsMessage) { dropped = append(dropped, request.Key) })
+	w := newTestWorker(prober)
+
+	now := time.Now()
+	w.handleRequest(testSubjectRequest("batch.job", "b1", now.Add(-time.Second*30)))
+	w.handleRequest(testSubjectRequest("default", "d1", now.Add(-time.Millisecond*500)))
+	w.handleRequest(testSubjectRequest("fast.rpc.get", "f1", now.Add(-time.Millisecond*30)))
+	w.handleRequest(testSubjectRequest("fast.rpc.get", "f2", now))
+	w.handleRequest(testSubjectRequest("batch.job", "b2", now))
+	w.handleRequest(testSubjectRequest("batch.job", "b3", now))
+
+	if len(dropped) != 1 || dropped[0] != "b3" {
+		t.Errorf("Wrong dropped requests %v", dropped)
+	}
+
+	w.checkTimeouts()
+	if len(timeouted) != 1 || timeouted[0] != "f1" {
+		t.Errorf("Wrong timeouted requests %v", timeouted)
+	}
+	if w.pendingRequests.Len() != 4 {
+		t.Errorf("Wrong pending count %d", w.pendingRequests.Len())
+	}
+}
+
+func TestWorkerTimeoutAccuracy(t *testing.T) {
+	prober := &NatsProber{
+		RequestTimeout:           time.Second,
+		WorkerMaxPendingRequests: 10,
+		Policies: []SubjectPolicy{
+			{Subject: "fast", Timeout: time.Millisecond * 30},
+		},
+	}
+	lateness := make(chan time.Duration, 2)
+	prober.SetTimeoutedRequestHandler(func(request *NatsMessage) {
+		lateness <- time.Since(request.ReceivedAt.Add(prober.requestTimeout(prober.policyIndex(request.Msg.Subject))))
+	})
+	w := startWorker(prober, 1)
+	defer w.stop()
+
+	// Inserted after a request with later deadline, must still fire first
+	w.addRequest(testSubjectRequest("slow", "slow", time.Now()))
+	w.addRequest(testSubjectRequest("fast", "fast", time.Now()))
+
+	// Timeouts typically fire within a millisecond of deadlines, see BenchmarkWorkerTimeoutLateness.
+	// The bound is loose to tolerate scheduling delays on loaded machines.
+	select {
+	case late := <-lateness:
+		if late < 0 || late > time.Millisecond*50 {
+			t.Errorf("Timeout fired %v after deadline", late)
+		}
+	case <-time.After(time.Millisecond * 500):
+		t.Fatal("Timeout didn't fire")
+	}
+}
+
+// BenchmarkWorkerTimeoutLateness reports how late timeouts fire after deadlines,
+// which is expected to be well under 10ms.
+func BenchmarkWorkerTimeoutLateness(b *testing.B) {
+	prober := &NatsProber{
+		RequestTimeout:           time.Millisecond,
+		WorkerMaxPendingRequests: 10,
+	}
+	lateness := make(chan time.Duration, 1)
+	prober.SetTimeoutedRequestHandler(func(request *NatsMessage) {
+		lateness <- time.Since(request.ReceivedAt.Add(prober.RequestTimeout))
+	})
+	w := startWorker(prober, 1)
+	defer w.stop()
+
+	var total, worst time.Duration
+	for i := 0; i < b.N; i++ {
+		w.addRequest(testRequest(strconv.Itoa(i), time.Now()))
+		late := <-lateness
+		total += late
+		if late > worst {
+			worst = late
+		}
+	}
+	b.ReportMetric(float64(total.Nanoseconds())/float64(b.N), "late-ns/op")
+	b.ReportMetric(float64(worst.Nanoseconds()), "max-late-ns")
+}
+
+func benchmarkWorker(b *testing.B, pending int) (*worker, time.Time) {
+	prober := &NatsProber{
+		RequestTimeout:           time.Minute,
+		WorkerMaxPendingRequests: uint(pending) + 1,
+		Policies: []SubjectPolicy{
+			{Subject: "a", Timeout: time.Second},
+			{Subject: "b", Timeout: time.Second * 10},
+		},
+	}
+	w := newTestWorker(prober)
+	subjects := []string{"a", "b", "c"}
+	now := time.Now()
+	for i := 0; i < pending; i++ {
+		w.handleRequest(testSubjectRequest(subjects[i%3], strconv.Itoa(i), now.Add(time.Duration(i%1000)*time.Millisecond)))
+	}
+	return w, now
+}
+
+func BenchmarkWorkerRequestResponse1M(b *testing.B) {
+	w, now := benchmarkWorker(b, 1000000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := "new" + strconv.Itoa(i)
+		w.handleRequest(testSubjectRequest("b", key, now))
+		w.handleResponse(testResponse(key, now))
+	}
+}
+
+func BenchmarkWorkerTimeouts1M(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		w, now := benchmarkWorker(b, 1000000)
+		for _, pending := range w.deadlines {
+			pending.deadline = now
+		}
+		b.StartTimer()
+		w.checkTimeouts()
+		if w.pendingRequests.Len() != 0 {
+			b.Fatalf("%d requests not timeouted", w.pendingRequests.Len())
+		}
+	}
+}
+
+func TestWorkerDropPolicies(t *testing.T) {
+	prober := &NatsProber{
+		RequestTimeout:           time.Minute,
+		WorkerMaxPendingRequests: 1,
+		Policies: []SubjectPolicy{
+			{Subject: "reject", MaxPending: 1, DropPolicy: RejectNew},
+			{Subject: "never", MaxPending: 1, DropPolicy: DropSample, SampleRate: 0},
+			{Subject: "always", MaxPending: 1, DropPolicy: DropSample, SampleRate: 1},
+		},
+	}
+	reasons := map[string]DropReason{}
+	prober.SetDroppedRequestReasonHandler(func(message *NatsMessage, reason DropReason) {
+		reasons[message.Key] = reason
+	})
+
+	for _, subject := range []string{"reject", "never", "always"} {
+		w := newTestWorker(prober)
+		w.handleRequest(testSubjectRequest(subject, subject+"1", time.Now()))
+		w.handleRequest(testSubjectRequest(subject, subject+"2", time.Now()))
+		if w.pendingRequests.Len() != 1 {
+			t.Errorf("%s: wrong pending count %d", subject, w.pendingRequests.Len())
+		}
+	}
+
+	expected := map[string]DropReason{
+		"never2":  DropReasonSampledOut,
+		"always1": DropReasonCapacity,
+	}
+	if len(reasons) != len(expected) {
+		t.Errorf("Wrong drops %v", reasons)
+	}
+	for key, reason := range expected {
+		if reasons[key] != reason {
+			t.Errorf("Wrong drop reason for %s: %q", key, reasons[key])
+		}
+	}
+}
+
+func TestWorkerNonBlockingEnqueue(t *testing.T) {
+	prober := &NatsProber{
+		WorkerQueueSize:    1,
+		NonBlockingEnqueue: true,
+	}
+	var reasons []DropReason
+	prober.SetDroppedRequestReasonHandler(func(_ *NatsMessage, reason DropReason) {
+		reasons = append(reasons, reason)
+	})
+	prober.SetDroppedResponseHandler(func(_ *NatsMessage, reason DropReason) {
+		reasons = append(reasons, reason)
+	})
+	w := newTestWorker(prober)
+	w.requests = make(chan *NatsMessage, prober.WorkerQueueSize)
+	w.responses = make(chan *NatsMessage, prober.WorkerQueueSize)
+
+	w.addRequest(testRequest("a", time.Now()))
+	w.addRequest(testRequest("b", time.Now()))
+	w.addResponse(testResponse("a", time.Now()))
+	w.addResponse(testResponse("b", time.Now()))
+
+	if len(reasons) != 2 || reasons[0] != DropReasonRequestQueueOverflow || reasons[1] != DropReasonResponseQueueOverflow {
+		t.Errorf("Wrong drop reasons %v", reasons)
+	}
+}
+
+func TestWorkerOrphanResponses(t *testing.T) {
+	prober := &NatsProber{
+		RequestTimeoutSeconds:    10,
+		WorkerMaxPendingRequests: 10,
+		OrphanResponseGrace:      time.Second,
+	}
+	var successful, unknown int
+	prober.SetSuccessfulResponseHandler(func(*NatsMessage, *NatsMessage) { successful++ })
+	prober.SetUnknownResponseHandler(func(*NatsMessage) { unknown++ })
+	w := newTestWorker(prober)
+
+	now := time.Now()
+	w.handleResponse(testResponse("a", now))
+	w.handleResponse(testResponse("b", now.Add(-time.Second*2)))
+	if successful != 0 || unknown != 0 {
+		t.Fatalf("Unmatched responses must be held")
+	}
+	w.handleRequest(testRequest("a", now.Add(-time.Millisecond)))
+	if successful != 1 {
+		t.Errorf("Held response must match late request")
+	}
+	w.checkTimeouts()
+	if unknown != 1 || w.orphanResponses.Len() != 0 {
+		t.Errorf("Expired response must be reported as unknown, got %d unknown", unknown)
+	}
+}
+
+func TestWorkerStatusResponses(t *testing.T) {
+	prober := &NatsProber{
+		RequestTimeoutSeconds:    10,
+		WorkerMaxPendingRequests: 10,
+	}
+	var statuses []int
+	var successful int
+	prober.SetNoRespondersHandler(func(_ *NatsMessage, _ *NatsMessage, status int) {
+		statuses = append(statuses, status)
+	})
+	prober.SetSuccessfulResponseHandler(func(*NatsMessage, *NatsMessage) { successful++ })
+	w := newTestWorker(prober)
+
+	now := time.Now()
+	w.handleRequest(testRequest("a", now))
+	w.handleRequest(testRequest("b", now))
+	w.handleRequest(testRequest("c", now))
+	w.handleResponse(&NatsMessage{Msg: &nats.Msg{Subject: "a", Header: nats.Header{"Status": []string{"503"}}}, Key: "a", ReceivedAt: now})
+	w.handleResponse(&NatsMessage{Msg: &nats.Msg{Subject: "b", Header: nats.Header{"Status": []string{"408"}, "Description": []string{"Request Timeout"}}}, Key: "b", ReceivedAt: now})
+	// Regular response that happens to have a Status header
+	w.handleResponse(&NatsMessage{Msg: &nats.Msg{Subject: "c", Data: []byte("ok"), Header: nats.Header{"Status": []string{"503"}}}, Key: "c", ReceivedAt: now})
+
+	if len(statuses) != 2 || statuses[0] != StatusNoResponders || statuses[1] != StatusTimeout {
+		t.Errorf("Wrong statuses %v", statuses)
+	}
+	if successful != 1 {
+		t.Errorf("Wrong successful count %d", successful)
+	}
+}
+
+func TestWorkerByteBudget(t *testing.T) {
+	prober := &NatsProber{
+		RequestTimeoutSeconds:    10,
+		WorkerMaxPendingRequests: 10,
+		WorkerMaxPendingBytes:    300,
+		MaxPendingBytes:          500,
+	}
+	var dropped []string
+	var reasons []DropReason
+	prober.SetDroppedRequestReasonHandler(func(request *NatsMessage, reason DropReason) {
+		dropped = append(dropped, request.Key)
+		reasons = append(reasons, reason)
+	})
+	w := newTestWorker(prober)
+	other := newTestWorker(prober)
+
+	request := func(key string, size int) *NatsMessage {
+		request := testRequest(key, time.Now())
+		request.Msg.Data = make([]byte, size-int(request.memorySize()))
+		return request
+	}
+	w.handleRequest(request("a", 100))
+	w.handleRequest(request("b", 100))
+	w.handleRequest(request("c", 150))
+	if len(dropped) != 1 || dropped[0] != "a" || reasons[0] != DropReasonMemory {
+		t.Fatalf("Oldest request must be evicted over worker budget, got %v %v", dropped, reasons)
+	}
+	if w.pendingBytes != 250 || prober.PendingBytes() != 250 {
+		t.Errorf("Wrong pending bytes %d, %d total", w.pendingBytes, prober.PendingBytes())
+	}
+
+	// Global budget only evicts requests of the worker adding a new one
+	other.handleRequest(request("d", 200))
+	other.handleRequest(request("e", 100))
+	if len(dropped) != 2 || dropped[1] != "d" || w.pendingRequests.Len() != 2 {
+		t.Errorf("Wrong dropped requests over global budget %v", dropped)
+	}
+	w.handleRequest(request("f", 400))
+	if len(dropped) != 3 || dropped[2] != "f" || w.pendingRequests.Len() != 2 {
+		t.Errorf("Request larger than worker budget must be dropped without evictions, got %v", dropped)
+	}
+	// Evicting all requests of the worker isn't enough while the other one holds the global budget
+	other.handleRequest(request("g", 250))
+	w.handleRequest(request("h", 260))
+	if len(dropped) != 5 || dropped[3] != "e" || dropped[4] != "h" || w.pendingRequests.Len() != 2 {
+		t.Errorf("Request not fitting global budget must be dropped without evictions, got %v", dropped)
+	}
+
+	w.handleResponse(testResponse("unknown", time.Now()))
+	w.handleResponse(testResponse("b", time.Now()))
+	w.handleResponse(testResponse("c", time.Now()))
+	other.handleResponse(testResponse("g", time.Now()))
+	if w.pendingBytes != 0 || prober.PendingBytes() != 0 {
+		t.Errorf("Wrong pending bytes %d, %d total after responses", w.pendingBytes, prober.PendingBytes())
+	}
+
+	prober.DropPolicy = DropNewest
+	w.handleRequest(request("i", 200))
+	w.handleRequest(request("j", 200))
+	if dropped[len(dropped)-1] != "j" || w.pendingRequests.Len() != 1 {
+		t.Errorf("Newest request must be dropped with drop newest policy, got %v", dropped)
+	}
+}
+
+func TestWorkerDuplicateRequests(t *testing.T) {
+	prober := &NatsProber{
+		RequestTimeoutSeconds:    10,
+		WorkerMaxPendingRequests: 10,
+	}
+	var superseded, successful []*NatsMessage
+	prober.SetSupersededRequestHandler(func(request *NatsMessage, supersededBy *NatsMessage) {
+		superseded = append(superseded, request, supersededBy)
+	})
+	prober.SetSuccessfulResponseHandler(func(request *NatsMessage, _ *NatsMessage) {
+		successful = append(successful, request)
+	})
+	w := newTestWorker(prober)
+
+	start := time.Now()
+	a0, a1 := testRequest("a", start), testRequest("a", start.Add(time.Millisecond))
+	w.handleRequest(a0)
+	w.handleRequest(a1)
+	w.handleResponse(testResponse("a", start.Add(time.Millisecond*2)))
+	if len(superseded) != 2 || superseded[0] != a0 || superseded[1] != a1 {
+		t.Errorf("Reused key must supersede pending request")
+	}
+	if len(successful) != 1 || successful[0] != a1 {
+		t.Errorf("Response must match the latest request")
+	}
+
+	prober.MaxDuplicateRequests = 1
+	superseded, successful = nil, nil
+	b0, b1, b2 := testRequest("b", start), testRequest("b", start.Add(time.Millisecond)), testRequest("b", start.Add(time.Millisecond*2))
+	w.handleRequest(b0)
+	w.handleRequest(b1)
+	w.handleRequest(b2)
+	if len(superseded) != 2 || superseded[0] != b0 || superseded[1] != b2 {
+		t.Errorf("Earliest request must be superseded beyond queue limit")
+	}
+	w.handleResponse(testResponse("b", start.Add(time.Millisecond*3)))
+	w.handleResponse(testResponse("b", start.Add(time.Millisecond*4)))
+	if len(successful) != 2 || successful[0] != b1 || successful[1] != b2 {
+		t.Errorf("Responses must match queued requests in order")
+	}
+	if w.pendingRequests.Len() != 0 || w.pendingBytes != 0 {
+		t.Errorf("Wrong pending count %d and bytes %d", w.pendingRequests.Len(), w.pendingBytes)
+	}
+}
+
+func TestWorkerDuplicateRequestLimits(t *testing.T) {
+	prober := &NatsProber{
+		RequestTimeoutSeconds:    10,
+		WorkerMaxPendingRequests: 10,
+		WorkerMaxPendingBytes:    300,
+		MaxDuplicateRequests:     5,
+		Policies: []SubjectPolicy{
+			{Subject: "limited", MaxPending: 2, DropPolicy: DropNewest},
+		},
+	}
+	var dropped []DropReason
+	prober.SetDroppedRequestReasonHandler(func(_ *NatsMessage, reason DropReason) {
+		dropped = append(dropped, reason)
+	})
+	w := newTestWorker(prober)
+
+	request := testRequest("a", time.Now())
+	request.Msg.Data = make([]byte, 100-int(request.memorySize()))
+	for i := 0; i < 6; i++ {
+		w.handleRequest(request)
+		if w.pendingBytes > 300 {
+			t.Fatalf("Queued requests exceeded byte budget with %d bytes", w.pendingBytes)
+		}
+	}
+	if len(dropped) != 3 || dropped[0] != DropReasonMemory || w.pendingBytes != 300 {
+		t.Errorf("Wrong drops %v with %d pending bytes", dropped, w.pendingBytes)
+	}
+
+	prober.WorkerMaxPendingBytes = 0
+	prober.WorkerMaxPendingRequests = 4
+	prober.DropPolicy = DropNewest
+	dropped = nil
+	w.handleRequest(testRequest("b", time.Now()))
+	w.handleRequest(testRequest("b", time.Now()))
+	if len(dropped) != 1 || dropped[0] != DropReasonCapacity || w.pendingRequests.Len()+w.queuedCount != 4 {
+		t.Errorf("Queued requests must count against pending requests limit, got %v with %d pending and %d queued",
+			dropped, w.pendingRequests.Len(), w.queuedCount)
+	}
+
+	prober.WorkerMaxPendingRequests = 10
+	dropped = nil
+	for i := 0; i < 3; i++ {
+		w.handleRequest(testSubjectRequest("limited", "c", time.Now()))
+	}
+	if len(dropped) != 1 || dropped[0] != DropReasonCapacity || w.policyQueued[0] != 1 {
+		t.Errorf("Queued requests must count against policy limit, got %v with %d queued", dropped, w.policyQueued[0])
+	}
+
+	for _, key := range []string{"a", "a", "a", "b", "c", "c"} {
+		w.handleResponse(testResponse(key, time.Now()))
+	}
+	if w.pendingRequests.Len() != 0 || w.queuedCount != 0 || w.policyQueued[0] != 0 || w.pendingBytes != 0 {
+		t.Errorf("Wrong pending count %d, queued %d and bytes %d after responses", w.pendingRequests.Len(), w.queuedCount, w.pendingBytes)
+	}
+}
+
+func TestWorkerUnlimitedPendingRequests(t *testing.T) {
+	prober := &NatsProber{
+		RequestTimeoutSeconds: 10,
+		OrphanResponseGrace:   time.Second,
+	}
+	var dropped, unknown int
+	prober.SetDroppedRequestHandler(func(*NatsMessage) { dropped++ })
+	prober.SetUnknownResponseHandler(func(*NatsMessage) { unknown++ })
+	w := newTestWorker(prober)
+
+	w.handleRequest(testRequest("a", time.Now()))
+	w.handleRequest(testRequest("b", time.Now()))
+	w.handleResponse(testResponse("c", time.Now()))
+	w.handleResponse(testResponse("d", time.Now()))
+	if dropped != 0 || unknown != 0 || w.pendingRequests.Len() != 2 || w.orphanResponses.Len() != 2 {
+		t.Errorf("Zero WorkerMaxPendingRequests must not limit requests, got %d dropped, %d unknown, %d pending, %d orphans",
+			dropped, unknown, w.pendingRequests.Len(), w.orphanResponses.Len())
+	}
+}
@@ -0,0 +1,142 @@
+package testutil
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aurora-is-near/nats-prober/natsprober"
+)
+
+// Recorder records outcomes reported to NatsProber's outcome-specific handlers as events.
+type Recorder struct {
+	mu     sync.Mutex
+	events map[natsprober.Outcome][]*natsprober.ProbeEvent
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{
+		events: make(map[natsprober.Outcome][]*natsprober.ProbeEvent),
+	}
+}
+
+// Attach sets prober's outcome handlers to record into r, it must be called before prober is started.
+func (r *Recorder) Attach(prober *natsprober.NatsProber) {
+	prober.SetSuccessfulResponseHandler(func(request *natsprober.NatsMessage, response *natsprober.NatsMessage) {
+		r.record(natsprober.NewProbeEvent(natsprober.OutcomeSuccessful, request, response))
+	})
+	prober.SetTimeoutedRequestHandler(func(request *natsprober.NatsMessage) {
+		r.record(natsprober.NewProbeEvent(natsprober.OutcomeTimeouted, request, nil))
+	})
+	prober.SetUnknownResponseHandler(func(response *natsprober.NatsMessage) {
+		r.record(natsprober.NewProbeEvent(natsprober.OutcomeUnknown, nil, response))
+	})
+	prober.SetDroppedRequestReasonHandler(func(request *natsprober.NatsMessage, reason natsprober.DropReason) {
+		event := natsprober.NewProbeEvent(natsprober.OutcomeDropped, request, nil)
+		event.DropReason = reason
+		r.record(event)
+	})
+	prober.SetDroppedResponseHandler(func(response *natsprober.NatsMessage, reason natsprober.DropReason) {
+		event := natsprober.NewProbeEvent(natsprober.OutcomeDropped, nil, response)
+		event.DropReason = reason
+		r.record(event)
+	})
+	prober.SetInvalidResponseHandler(func(request *natsprober.NatsMessage, response *natsprober.NatsMessage, reason error) {
+		event := natsprober.NewProbeEvent(natsprober.OutcomeInvalid, request, response)
+		event.InvalidReason = reason.Error()
+		r.record(event)
+	})
+	prober.SetNoRespondersHandler(func(request *natsprober.NatsMessage, response *natsprober.NatsMessage, status int) {
+		event := natsprober.NewProbeEvent(natsprober.OutcomeNoResponders, request, response)
+		event.Status = status
+		r.record(event)
+	})
+	prober.SetGatheredResponseHandler(func(request *natsprober.NatsMessage, response *natsprober.NatsMessage, ordinal uint) {
+		event := natsprober.NewProbeEvent(natsprober.OutcomeGatheredResponse, request, response)
+		event.Ordinal = ordinal
+		r.record(event)
+	})
+	prober.SetPublishHandler(func(message *natsprober.NatsMessage) {
+		r.record(natsprober.NewProbeEvent(natsprober.OutcomePublish, message, nil))
+	})
+	prober.SetSupersededRequestHandler(func(request *natsprober.NatsMessage, _ *natsprober.NatsMessage) {
+		r.record(natsprober.NewProbeEvent(natsprober.OutcomeSuperseded, request, nil))
+	})
+	prober.SetAbandonedRequestHandler(func(request *natsprober.NatsMessage) {
+		r.record(natsprober.NewProbeEvent(natsprober.OutcomeAbandoned, request, nil))
+	})
+	prober.SetGatherCompletedHandler(func(request *natsprober.NatsMessage, result *natsprober.GatherResult) {
+		event := natsprober.NewProbeEvent(natsprober.OutcomeGatherCompleted, request, nil)
+		event.Responses = result.Responses
+		event.Latency = result.FirstLatency
+		event.LastLatency = result.LastLatency
+		r.record(event)
+	})
+}
+
+func (r *Recorder) record(event *natsprober.ProbeEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events[event.Outcome] = append(r.events[event.Outcome], event)
+}
+
+// Count returns number of recorded events with outcome.
+func (r *Recorder) Count(outcome natsprober.Outcome) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.events[outcome])
+}
+
+// Events returns recorded events with outcome in order they were reported.
+func (r *Recorder) Events(outcome natsprober.Outcome) []*natsprober.ProbeEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*natsprober.ProbeEvent(nil), r.events[outcome]...)
+}
+
+// Counts returns numbers of recorded events by outcome.
+func (r *Recorder) Counts() map[natsprober.Outcome]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	counts := make(map[natsprober.Outcome]int, len(r.events))
+	for outcome, events := range r.events {
+		counts[outcome] = len(events)
+	}
+	return counts
+}
+
+// WaitCount waits until at least count events with outcome are recorded,
+// failing the test after DefaultTimeout.
+func (r *Recorder) WaitCount(t testing.TB, outcome natsprober.Outcome, count int) {
+	t.Helper()
+	deadline := time.Now().Add(DefaultTimeout)
+	for r.Count(outcome) < count {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %d %s outcomes, got %v", count, outcome, r.Counts())
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+}
+
+// AssertCounts checks that exactly expected numbers of events were recorded,
+// outcomes missing in expected must not be recorded at all.
+func (r *Recorder) AssertCounts(t testing.TB, expected map[natsprober.Outcome]int) {
+	t.Helper()
+	counts := r.Counts()
+	outcomes := make([]string, 0, len(counts)+len(expected))
+	for outcome := range counts {
+		outcomes = append(outcomes, string(outcome))
+	}
+	for outcome := range expected {
+		if _, ok := counts[outcome]; !ok {
+			outcomes = append(outcomes, string(outcome))
+		}
+	}
+	sort.Strings(outcomes)
+	for _, outcome := range outcomes {
+		if got, want := counts[natsprober.Outcome(outcome)], expected[natsprober.Outcome(outcome)]; got != want {
+			t.Errorf("Wrong number of %s outcomes: got %d, want %d", outcome, got, want)
+		}
+	}
+}
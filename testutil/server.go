@@ -0,0 +1,87 @@
+// Package testutil helps testing the prober and logger against an in-process NATS server.
+package testutil
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+)
+
+// DefaultTimeout bounds waits of Recorder and Subscription helpers.
+var DefaultTimeout = time.Second * 5
+
+// RunServer starts NATS server on a random port, it's shut down when the test ends.
+func RunServer(t testing.TB) *server.Server {
+	t.Helper()
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+	s := natsserver.RunServer(&opts)
+	t.Cleanup(s.Shutdown)
+	return s
+}
+
+// Connect connects to server, the connection is closed when the test ends.
+func Connect(t testing.TB, s *server.Server) *nats.Conn {
+	t.Helper()
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatalf("Can't connect to NATS: %v", err)
+	}
+	t.Cleanup(nc.Close)
+	return nc
+}
+
+// Flush makes sure all messages published on connections so far were processed by server.
+func Flush(t testing.TB, conns ...*nats.Conn) {
+	t.Helper()
+	for _, nc := range conns {
+		if err := nc.Flush(); err != nil {
+			t.Fatalf("Can't flush NATS connection: %v", err)
+		}
+	}
+}
+
+// Subscription collects messages published to a subject.
+type Subscription struct {
+	messages chan *nats.Msg
+}
+
+// Subscribe starts collecting messages published to subject.
+func Subscribe(t testing.TB, nc *nats.Conn, subject string) *Subscription {
+	t.Helper()
+	s := &Subscription{
+		messages: make(chan *nats.Msg, 10000),
+	}
+	sub, err := nc.ChanSubscribe(subject, s.messages)
+	if err != nil {
+		t.Fatalf("Can't subscribe to '%s': %v", subject, err)
+	}
+	t.Cleanup(func() { sub.Unsubscribe() })
+	Flush(t, nc)
+	return s
+}
+
+// Next waits for the next message, failing the test after DefaultTimeout.
+func (s *Subscription) Next(t testing.TB) *nats.Msg {
+	t.Helper()
+	select {
+	case msg := <-s.messages:
+		return msg
+	case <-time.After(DefaultTimeout):
+		t.Fatalf("Timed out waiting for message")
+		return nil
+	}
+}
+
+// AssertNoMore fails the test if a message arrives within the given duration.
+func (s *Subscription) AssertNoMore(t testing.TB, wait time.Duration) {
+	t.Helper()
+	select {
+	case msg := <-s.messages:
+		t.Errorf("Unexpected message on '%s': %q", msg.Subject, msg.Data)
+	case <-time.After(wait):
+	}
+}
@@ -0,0 +1,89 @@
+package testutil
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Behavior describes how FakeService handles a single request.
+type Behavior struct {
+	// Latency before replying
+	Latency time.Duration
+	// Drop leaves request without reply
+	Drop bool
+	// Duplicates is the number of extra identical replies
+	Duplicates uint
+}
+
+// FakeService replies to requests on a subject echoing their data, following a script.
+type FakeService struct {
+	nc     *nats.Conn
+	script []Behavior
+
+	mu       sync.Mutex
+	requests int
+	wg       sync.WaitGroup
+}
+
+// StartFakeService subscribes service to subject. Requests are handled with behaviors
+// of the script in order of arrival, the last one is repeated. Requests are replied
+// to immediately if script is empty.
+func StartFakeService(t testing.TB, nc *nats.Conn, subject string, script ...Behavior) *FakeService {
+	t.Helper()
+	s := &FakeService{
+		nc:     nc,
+		script: script,
+	}
+	sub, err := nc.Subscribe(subject, s.handleRequest)
+	if err != nil {
+		t.Fatalf("Can't subscribe fake service to '%s': %v", subject, err)
+	}
+	Flush(t, nc)
+	t.Cleanup(func() {
+		sub.Unsubscribe()
+		s.wg.Wait()
+	})
+	return s
+}
+
+func (s *FakeService) handleRequest(msg *nats.Msg) {
+	s.mu.Lock()
+	var behavior Behavior
+	if len(s.script) > 0 {
+		if s.requests < len(s.script) {
+			behavior = s.script[s.requests]
+		} else {
+			behavior = s.script[len(s.script)-1]
+		}
+	}
+	s.requests++
+	s.mu.Unlock()
+
+	if behavior.Drop || len(msg.Reply) == 0 {
+		return
+	}
+	reply := func() {
+		for i := uint(0); i <= behavior.Duplicates; i++ {
+			s.nc.Publish(msg.Reply, msg.Data)
+		}
+	}
+	if behavior.Latency == 0 {
+		reply()
+		return
+	}
+	s.wg.Add(1)
+	time.AfterFunc(behavior.Latency, func() {
+		defer s.wg.Done()
+		reply()
+	})
+}
+
+// Requests returns number of requests received so far.
+func (s *FakeService) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}